@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// RequestAuthenticator authenticates requests made to a target.
+type RequestAuthenticator interface {
+	// Apply adds authentication to the request, e.g. by setting a header.
+	Apply(*http.Request) error
+}
+
+// BasicAuth is the credentials used to authenticate with a target using
+// HTTP basic authentication.
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// PasswordFile is the path of a file holding the password, read on
+	// every scrape, instead of Password.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// OAuth2 is the configuration of the OAuth2 client credentials flow used to
+// authenticate with a target.
+type OAuth2 struct {
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	TokenURL     string   `yaml:"token_url"`
+	Scopes       []string `yaml:"scopes"`
+	// ClientSecretFile is the path of a file holding the client secret,
+	// read when the config is loaded, instead of ClientSecret.
+	ClientSecretFile string `yaml:"client_secret_file"`
+}
+
+// newAuthenticator returns the authenticator configured for target t, or nil
+// if the target doesn't require authentication. Requests it makes itself,
+// e.g. for OAuth2 tokens, time out after timeout.
+func newAuthenticator(t Target, timeout time.Duration) (RequestAuthenticator, error) {
+	var auths []RequestAuthenticator
+	if t.BasicAuth != nil {
+		if t.BasicAuth.Username == "" {
+			return nil, fmt.Errorf("basic_auth: username must be set")
+		}
+		if t.BasicAuth.Password != "" && t.BasicAuth.PasswordFile != "" {
+			return nil, fmt.Errorf("basic_auth: at most one of password and password_file can be set")
+		}
+		auths = append(auths, basicAuth{BasicAuth: *t.BasicAuth, vault: t.vault})
+	}
+	if t.BearerToken != "" {
+		auths = append(auths, bearerTokenAuth{token: t.BearerToken, vault: t.vault})
+	}
+	if t.BearerTokenFile != "" {
+		auths = append(auths, bearerTokenFileAuth{path: t.BearerTokenFile})
+	}
+	if t.OAuth2 != nil {
+		if t.OAuth2.ClientID == "" || t.OAuth2.TokenURL == "" {
+			return nil, fmt.Errorf("oauth2: client_id and token_url must be set")
+		}
+		c := *t.OAuth2
+		if c.ClientSecretFile != "" {
+			if c.ClientSecret != "" {
+				return nil, fmt.Errorf("oauth2: at most one of client_secret and client_secret_file can be set")
+			}
+			secret, err := readSecretFile(c.ClientSecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("oauth2: %w", err)
+			}
+			c.ClientSecret = secret
+		}
+		secret, err := t.vault.expand(c.ClientSecret)
+		if err != nil {
+			return nil, fmt.Errorf("oauth2: %w", err)
+		}
+		c.ClientSecret = secret
+		auths = append(auths, newOAuth2Auth(c, t.httpClient(), timeout))
+	}
+	if t.SigV4 != nil {
+		auth, err := newSigV4Auth(*t.SigV4, t.vault)
+		if err != nil {
+			return nil, fmt.Errorf("sigv4: %w", err)
+		}
+		auths = append(auths, auth)
+	}
+	switch len(auths) {
+	case 0:
+		return nil, nil
+	case 1:
+		return auths[0], nil
+	default:
+		return nil, fmt.Errorf("at most one of basic_auth, bearer_token, bearer_token_file, oauth2 and sigv4 can be set")
+	}
+}
+
+// basicAuth authenticates with a username and password.
+type basicAuth struct {
+	BasicAuth
+	vault *vaultClient
+}
+
+func (a basicAuth) Apply(req *http.Request) error {
+	password, err := a.vault.expand(a.Password)
+	if err != nil {
+		return err
+	}
+	if a.PasswordFile != "" {
+		if password, err = readSecretFile(a.PasswordFile); err != nil {
+			return err
+		}
+	}
+	req.SetBasicAuth(a.Username, password)
+	return nil
+}
+
+// bearerTokenAuth authenticates with a bearer token, given as is or as a
+// reference to a Vault secret.
+type bearerTokenAuth struct {
+	token string
+	vault *vaultClient
+}
+
+func (a bearerTokenAuth) Apply(req *http.Request) error {
+	token, err := a.vault.expand(a.token)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// bearerTokenFileAuth authenticates with a bearer token read from a file.
+type bearerTokenFileAuth struct {
+	path string
+}
+
+func (a bearerTokenFileAuth) Apply(req *http.Request) error {
+	token, err := readSecretFile(a.path)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// oauth2Auth authenticates with an access token obtained through the OAuth2
+// client credentials flow. The token is cached and only requested again once
+// it expires. Tokens are requested with the same client as metrics, so going
+// through the same proxy and with the same TLS config, and within the
+// context of the request being authenticated, so that they don't outlive
+// the scrape.
+type oauth2Auth struct {
+	cfg    *clientcredentials.Config
+	client *http.Client
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func newOAuth2Auth(c OAuth2, client *http.Client, timeout time.Duration) *oauth2Auth {
+	tokenClient := *client
+	tokenClient.Timeout = timeout
+	return &oauth2Auth{
+		cfg: &clientcredentials.Config{
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			TokenURL:     c.TokenURL,
+			Scopes:       c.Scopes,
+		},
+		client: &tokenClient,
+	}
+}
+
+func (a *oauth2Auth) Apply(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.token.Valid() {
+		ctx := context.WithValue(req.Context(), oauth2.HTTPClient, a.client)
+		token, err := a.cfg.Token(ctx)
+		if err != nil {
+			return err
+		}
+		a.token = token
+	}
+	a.token.SetAuthHeader(req)
+	return nil
+}
+
+// readSecretFile reads a secret from a file, trimming surrounding whitespace.
+// The file is read anew every time so that rotated secrets are picked up.
+// Files that are atomically swapped, as Kubernetes does when updating
+// mounted secrets, may briefly be missing so reading them is retried for a
+// little while.
+func readSecretFile(path string) (string, error) {
+	const attempts = 5
+	for i := 1; ; i++ {
+		b, err := os.ReadFile(path)
+		if err == nil {
+			return string(bytes.TrimSpace(b)), nil
+		}
+		if !os.IsNotExist(err) || i == attempts {
+			return "", err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
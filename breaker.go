@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is the error of targets skipped because their circuit
+// breaker is open.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// breaker is the circuit breaker state of a target.
+type breaker struct {
+	// failures is the number of consecutive failed scrapes.
+	failures int
+	// openUntil is when the next attempt to scrape the target is allowed,
+	// once failures reached the threshold.
+	openUntil time.Time
+}
+
+var (
+	breakersMu sync.Mutex
+	// breakers is the circuit breaker state of targets, by target key, so
+	// that it's kept across config reloads as long as the target remains.
+	breakers = map[string]*breaker{}
+)
+
+// breakerAllows reports whether target t can be scraped now. Once the
+// cooldown of an open breaker is over, a single scrape is let through to
+// check whether the target is back, other scrapes being skipped for another
+// cooldown meanwhile.
+func breakerAllows(t Target) bool {
+	if t.BreakerThreshold <= 0 {
+		return true
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b := breakers[t.key()]
+	if b == nil || b.failures < t.BreakerThreshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(t.BreakerCooldown)
+	return true
+}
+
+// recordBreaker updates the circuit breaker of target t with the outcome of
+// scraping it.
+func recordBreaker(t Target, err error) {
+	if t.BreakerThreshold <= 0 {
+		return
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	key := t.key()
+	b := breakers[key]
+	if b == nil {
+		b = &breaker{}
+		breakers[key] = b
+	}
+	if err == nil {
+		b.failures = 0
+	} else {
+		b.failures++
+		if b.failures == t.BreakerThreshold {
+			b.openUntil = time.Now().Add(t.BreakerCooldown)
+		}
+	}
+	setGauge(targetBreakerOpen.WithLabelValues(t.URL, key), b.failures >= t.BreakerThreshold)
+}
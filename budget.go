@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// memoryBudget bounds the bytes of target responses being read and parsed
+// at once across concurrent fetches. Reading a response waits while the
+// budget is used up, except for the oldest fetch in flight, which always
+// proceeds so that fetches can't end up all waiting for each other. The
+// budget may thus be exceeded by at most one response.
+type memoryBudget struct {
+	limit int64
+
+	mu   sync.Mutex
+	used int64
+	// peak is the highest number of bytes used at once.
+	peak int64
+	// fetches are the tickets of the fetches in flight, oldest first.
+	fetches []uint64
+	next    uint64
+	// freed is closed, and replaced, whenever bytes are given back, to wake
+	// up waiting fetches.
+	freed chan struct{}
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit, freed: make(chan struct{})}
+}
+
+// budgetReader reads a response from r, taking what it reads from the
+// budget until closed.
+type budgetReader struct {
+	r      io.Reader
+	ctx    context.Context
+	b      *memoryBudget
+	ticket uint64
+	n      int64
+}
+
+// reader returns a reader of r taking what it reads from b, waiting until ctx
+// is done if b is used up. It must be closed to give back what it took.
+func (b *memoryBudget) reader(ctx context.Context, r io.Reader) *budgetReader {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ticket := b.next
+	b.next++
+	b.fetches = append(b.fetches, ticket)
+	return &budgetReader{r: r, ctx: ctx, b: b, ticket: ticket}
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	// Room is taken for all of p, and what isn't read given back.
+	if err := r.b.take(r.ctx, r.ticket, int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	r.b.giveBack(int64(len(p) - n))
+	return n, err
+}
+
+// Close gives back what was read to the budget.
+func (r *budgetReader) Close() error {
+	r.b.give(r.ticket, r.n)
+	return nil
+}
+
+// take takes n bytes from the budget for the fetch with ticket, waiting
+// until there is room for them unless it's the oldest fetch in flight.
+func (b *memoryBudget) take(ctx context.Context, ticket uint64, n int64) error {
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit || b.fetches[0] == ticket {
+			b.used += n
+			if b.used > b.peak {
+				b.peak = b.used
+			}
+			b.mu.Unlock()
+			return nil
+		}
+		freed := b.freed
+		b.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// giveBack gives back n bytes taken but not used.
+func (b *memoryBudget) giveBack(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.wake()
+}
+
+// give gives back the n bytes taken by the fetch with ticket, which is done.
+func (b *memoryBudget) give(ticket uint64, n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	for i, t := range b.fetches {
+		if t == ticket {
+			b.fetches = append(b.fetches[:i], b.fetches[i+1:]...)
+			break
+		}
+	}
+	b.wake()
+}
+
+// wake wakes up the fetches waiting for room. b.mu must be held.
+func (b *memoryBudget) wake() {
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// cachedFetch is the metrics fetched from a target at some point.
+type cachedFetch struct {
+	at             time.Time
+	metricFamilies map[string]*dto.MetricFamily
+}
+
+var (
+	fetchCacheMu sync.Mutex
+	// fetchCache is the last metrics fetched from targets with a cache_ttl
+	// or stale_max_age, by target key.
+	fetchCache = map[string]cachedFetch{}
+)
+
+// key identifies target t in what's kept about targets across scrapes.
+// Targets with the same URL may be fetched differently or be labeled
+// differently, so their headers, authentication and labels are part of it.
+func (t Target) key() string {
+	b, err := json.Marshal(struct {
+		Headers         map[string]string
+		Labels          map[string]string
+		BasicAuth       *BasicAuth
+		BearerToken     string
+		BearerTokenFile string
+		OAuth2          *OAuth2
+		SigV4           *SigV4
+	}{t.Headers, t.Labels, t.BasicAuth, t.BearerToken, t.BearerTokenFile, t.OAuth2, t.SigV4})
+	if err != nil {
+		// Only the URL is left to tell targets apart.
+		return t.URL
+	}
+	sum := sha256.Sum256(b)
+	return t.URL + "#" + hex.EncodeToString(sum[:6])
+}
+
+// fetchMetricsCached is like fetchMetrics but reuses the metrics last
+// fetched from target t if they are more recent than its cache_ttl. If
+// fetching fails, the metrics last fetched are returned along with the error
+// if they are more recent than its stale_max_age.
+func fetchMetricsCached(ctx context.Context, t Target) (map[string]*dto.MetricFamily, error) {
+	if t.CacheTTL <= 0 && t.StaleMaxAge <= 0 {
+		return fetchMetrics(ctx, t)
+	}
+	key := t.key()
+	fetchCacheMu.Lock()
+	c, ok := fetchCache[key]
+	fetchCacheMu.Unlock()
+	age := targetCacheAge.WithLabelValues(t.URL, key)
+	if ok && time.Since(c.at) < t.CacheTTL {
+		age.Set(time.Since(c.at).Seconds())
+		return cloneMetricFamilies(c.metricFamilies), nil
+	}
+	metricFamilies, err := fetchMetrics(ctx, t)
+	if err != nil {
+		stale := ok && time.Since(c.at) < t.StaleMaxAge
+		if t.StaleMaxAge > 0 {
+			setGauge(targetStale.WithLabelValues(t.URL), stale)
+		}
+		if stale {
+			age.Set(time.Since(c.at).Seconds())
+			return cloneMetricFamilies(c.metricFamilies), err
+		}
+		return nil, err
+	}
+	if t.StaleMaxAge > 0 {
+		setGauge(targetStale.WithLabelValues(t.URL), false)
+	}
+	fetchCacheMu.Lock()
+	fetchCache[key] = cachedFetch{at: time.Now(), metricFamilies: cloneMetricFamilies(metricFamilies)}
+	fetchCacheMu.Unlock()
+	age.Set(0)
+	return metricFamilies, nil
+}
+
+// cloneMetricFamilies deep copies metric families, which are modified in
+// place when transformed and merged.
+func cloneMetricFamilies(mfs map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	clone := make(map[string]*dto.MetricFamily, len(mfs))
+	for name, mf := range mfs {
+		clone[name] = proto.Clone(mf).(*dto.MetricFamily)
+	}
+	return clone
+}
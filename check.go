@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// checkConfig fully validates the config at path, which on top of loading
+// it means rejecting unknown fields, e.g. misspelled options which would
+// otherwise be silently ignored.
+func checkConfig(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	files, err := includedFiles(path, cfg.Include)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, err := loadInclude(file, true); err != nil {
+			return fmt.Errorf("include %s: %w", file, err)
+		}
+	}
+	f, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return err
+	}
+	return checkTargetFields(c.Targets)
+}
+
+// checkTargetFields rejects the fields the targets were given in the config
+// but don't have. Targets decode themselves, so these aren't caught by the
+// decoder even when it rejects unknown fields.
+func checkTargetFields(targets []Target) error {
+	for _, t := range targets {
+		if len(t.unknownFields) > 0 {
+			return fmt.Errorf("target %s: %s", t.URL, strings.Join(t.unknownFields, "; "))
+		}
+	}
+	return nil
+}
+
+// unknownFields returns where node, which is decoded into a value of type t,
+// has fields that t doesn't, including in the structs nested in t.
+func unknownFields(node *yaml.Node, t reflect.Type) []string {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var unknown []string
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if key.Tag == "!!merge" {
+				continue
+			}
+			f, ok := fields[key.Value]
+			if !ok {
+				unknown = append(unknown, fmt.Sprintf("line %d: field %s not found", key.Line, key.Value))
+				continue
+			}
+			unknown = append(unknown, unknownFields(node.Content[i+1], f.Type)...)
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for _, n := range node.Content {
+			unknown = append(unknown, unknownFields(n, t.Elem())...)
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			unknown = append(unknown, unknownFields(node.Content[i], t.Elem())...)
+		}
+	}
+	return unknown
+}
+
+// yamlFields returns the exported fields of struct type t by their name in
+// YAML.
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
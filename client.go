@@ -0,0 +1,204 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ProxyAuth is the credentials used to authenticate with a proxy.
+type ProxyAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// PasswordFile is the path of a file holding the password, read when
+	// the config is loaded, instead of Password.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// defaultClient is used to fetch metrics from targets without a client of
+// their own.
+var defaultClient = &http.Client{Transport: newTransport()}
+
+// httpClient returns the client to fetch metrics from the target with.
+func (t Target) httpClient() *http.Client {
+	if t.client == nil {
+		return defaultClient
+	}
+	return t.client
+}
+
+// prepareRequest adds the configured headers of the target to req and
+// authenticates it.
+func (t Target) prepareRequest(req *http.Request) error {
+	for name, value := range t.Headers {
+		req.Header.Set(name, value)
+	}
+	if t.auth != nil {
+		if err := t.auth.Apply(req); err != nil {
+			return fmt.Errorf("failed to authenticate request: %w", err)
+		}
+	}
+	return nil
+}
+
+// decodeContent returns the body of resp decoded according to its
+// Content-Encoding.
+func decodeContent(resp *http.Response) (io.Reader, error) {
+	switch enc := strings.ToLower(resp.Header.Get("Content-Encoding")); enc {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		return zlib.NewReader(resp.Body)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", enc)
+	}
+}
+
+// errBodySizeLimit is returned by limitedReader past its limit.
+var errBodySizeLimit = errors.New("body size limit exceeded")
+
+// limitedReader reads from r until more than n bytes were read, failing
+// with errBodySizeLimit from then on.
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.exceeded {
+		return 0, errBodySizeLimit
+	}
+	// Reading one byte past the limit tells a body of exactly n bytes apart
+	// from a larger one.
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if r.n < 0 {
+		r.exceeded = true
+		return 0, errBodySizeLimit
+	}
+	return n, err
+}
+
+// headerName matches valid HTTP header names.
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// expandHeader validates a header and returns its value with references to
+// env vars expanded. Referencing an unset env var is an error.
+func expandHeader(name, value string) (string, error) {
+	if !headerName.MatchString(name) {
+		return "", fmt.Errorf("invalid header name %q", name)
+	}
+	var unset []string
+	v := os.Expand(value, func(env string) string {
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			unset = append(unset, env)
+		}
+		return v
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("header %s: unset env vars %s", name, strings.Join(unset, ", "))
+	}
+	if strings.ContainsAny(v, "\r\n\x00") {
+		return "", fmt.Errorf("header %s: invalid value", name)
+	}
+	return v, nil
+}
+
+// newTransport returns a clone of the default transport which keeps track of
+// the connections it opens.
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		openConnections.Inc()
+		return &trackedConn{Conn: conn, mark: openConnections}, nil
+	}
+	return transport
+}
+
+// trackedConn is a connection counted in a high-water mark, openConnections
+// when it was opened, until closed.
+type trackedConn struct {
+	net.Conn
+	mark      *highWaterMark
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(c.mark.Dec)
+	return c.Conn.Close()
+}
+
+// newTargetClient returns an HTTP client for fetching metrics from target t.
+func newTargetClient(t Target) (*http.Client, error) {
+	transport := newTransport()
+	if t.TLSConfig != nil {
+		tc, err := t.TLSConfig.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("tls_config: %w", err)
+		}
+		transport.TLSClientConfig = tc
+	}
+	if t.ProxyURL != "" {
+		u, err := url.Parse(t.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if t.ProxyAuth != nil {
+		if t.ProxyAuth.Username == "" {
+			return nil, fmt.Errorf("proxy_auth: username must be set")
+		}
+		// Credentials in the proxy URL are sent by the transport in the
+		// Proxy-Authorization header, both for plain HTTP requests and for
+		// CONNECT requests tunneling HTTPS.
+		password := t.ProxyAuth.Password
+		if t.ProxyAuth.PasswordFile != "" {
+			if password != "" {
+				return nil, fmt.Errorf("proxy_auth: at most one of password and password_file can be set")
+			}
+			var err error
+			if password, err = readSecretFile(t.ProxyAuth.PasswordFile); err != nil {
+				return nil, fmt.Errorf("proxy_auth: %w", err)
+			}
+		}
+		password, err := t.vault.expand(password)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_auth: %w", err)
+		}
+		user := url.UserPassword(t.ProxyAuth.Username, password)
+		proxy := transport.Proxy
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			u, err := proxy(req)
+			if u == nil || err != nil {
+				return u, err
+			}
+			u2 := *u
+			u2.User = user
+			return &u2, nil
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
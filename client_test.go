@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestLimitedReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		limit   int64
+		wantErr bool
+	}{
+		{name: "below", size: 10, limit: 11},
+		{name: "equal", size: 10, limit: 10},
+		{name: "above", size: 11, limit: 10, wantErr: true},
+		{name: "empty", size: 0, limit: 0},
+		{name: "zero limit", size: 1, limit: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		for _, oneByte := range []bool{false, true} {
+			oneByte := oneByte
+			t.Run(fmt.Sprintf("%s/one byte %v", tt.name, oneByte), func(t *testing.T) {
+				var r io.Reader = strings.NewReader(strings.Repeat("x", tt.size))
+				if oneByte {
+					r = iotest.OneByteReader(r)
+				}
+				limited := &limitedReader{r: r, n: tt.limit}
+				b, err := io.ReadAll(limited)
+				if tt.wantErr {
+					if !errors.Is(err, errBodySizeLimit) || !limited.exceeded {
+						t.Errorf("got error %v and exceeded %v, want errBodySizeLimit", err, limited.exceeded)
+					}
+					return
+				}
+				if err != nil || limited.exceeded {
+					t.Fatalf("got error %v and exceeded %v, want neither", err, limited.exceeded)
+				}
+				if len(b) != tt.size {
+					t.Errorf("read %d bytes, want %d", len(b), tt.size)
+				}
+			})
+		}
+	}
+}
+
+func TestBodySizeLimit(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("# TYPE a gauge\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&b, "a{i=\"%d\"} 1\n", i)
+	}
+	body := b.String()
+	size := int64(len(body))
+	tests := []struct {
+		name         string
+		globalLimit  int64
+		targetLimit  int64
+		gzip         bool
+		wantExceeded bool
+	}{
+		{name: "default"},
+		{name: "within", globalLimit: size},
+		{name: "exceeded", globalLimit: size - 1, wantExceeded: true},
+		{name: "target overrides", globalLimit: size / 2, targetLimit: size},
+		{name: "target exceeded", globalLimit: size, targetLimit: size - 1, wantExceeded: true},
+		{name: "decoded size", globalLimit: size - 1, gzip: true, wantExceeded: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tt.gzip {
+					w.Write([]byte(body))
+					return
+				}
+				var b bytes.Buffer
+				zw := gzip.NewWriter(&b)
+				zw.Write([]byte(body))
+				zw.Close()
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(b.Bytes())
+			}))
+			defer srv.Close()
+			config := "targets:\n  - url: " + srv.URL + "\n"
+			if tt.targetLimit > 0 {
+				config += fmt.Sprintf("    body_size_limit: %d\n", tt.targetLimit)
+			}
+			if tt.globalLimit > 0 {
+				config = fmt.Sprintf("body_size_limit: %d\n", tt.globalLimit) + config
+			}
+			cfg := loadTestConfig(t, config)
+
+			mfs, err := fetchMetrics(context.Background(), cfg.Targets[0])
+			if tt.wantExceeded {
+				if err == nil || !strings.Contains(err.Error(), "exceeds body_size_limit") {
+					t.Errorf("got error %v, want body_size_limit exceeded", err)
+				}
+				if mfs != nil {
+					t.Errorf("got metrics %v, want none", mfs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(mfs["a"].GetMetric()); got != 100 {
+				t.Errorf("got %d series, want 100", got)
+			}
+		})
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "client" || pass != "secret" || r.FormValue("grant_type") != "client_credentials" {
+			http.Error(w, "bad client credentials", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "oauth2-token", "token_type": "bearer", "expires_in": 3600}`)
+	}))
+	defer tokenSrv.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config string
+		// check returns what's wrong with the authentication of r.
+		check func(r *http.Request) string
+	}{
+		{
+			name:   "basic",
+			config: "basic_auth: {username: user, password: pass}",
+			check: func(r *http.Request) string {
+				if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+					return fmt.Sprintf("got basic auth %q %q, want user pass", user, pass)
+				}
+				return ""
+			},
+		},
+		{
+			name:   "bearer",
+			config: "bearer_token: token",
+			check:  wantAuthorization("Bearer token"),
+		},
+		{
+			name:   "bearer_file",
+			config: "bearer_token_file: " + tokenFile,
+			check:  wantAuthorization("Bearer file-token"),
+		},
+		{
+			name:   "oauth2",
+			config: "oauth2: {client_id: client, client_secret: secret, token_url: " + tokenSrv.URL + "}",
+			check:  wantAuthorization("Bearer oauth2-token"),
+		},
+		{
+			name:   "sigv4",
+			config: "sigv4: {region: eu-west-1, access_key: AKIDEXAMPLE, secret_key: secret}",
+			check: func(r *http.Request) string {
+				auth := r.Header.Get("Authorization")
+				if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+					!strings.Contains(auth, "/eu-west-1/execute-api/aws4_request") ||
+					!strings.Contains(auth, "Signature=") {
+					return fmt.Sprintf("got Authorization %q, want a SigV4 signature of AKIDEXAMPLE for execute-api in eu-west-1", auth)
+				}
+				if r.Header.Get("X-Amz-Date") == "" {
+					return "got no X-Amz-Date header, want the signing time"
+				}
+				return ""
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if problem := tt.check(r); problem != "" {
+					t.Error(problem)
+					http.Error(w, problem, http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprint(w, "# TYPE up gauge\nup 1\n")
+			}))
+			defer srv.Close()
+			cfg := loadTestConfig(t, "targets:\n  - url: "+srv.URL+"\n    "+tt.config+"\n")
+
+			if _, err := fetchMetrics(context.Background(), cfg.Targets[0]); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// wantAuthorization returns a check of the authentication of requests that
+// their Authorization header is want.
+func wantAuthorization(want string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if got := r.Header.Get("Authorization"); got != want {
+			return fmt.Sprintf("got Authorization %q, want %q", got, want)
+		}
+		return ""
+	}
+}
+
+func TestScrapeBytesTotal(t *testing.T) {
+	body := "# TYPE a gauge\na 1\n"
+	tests := []struct {
+		name string
+		gzip bool
+	}{
+		{name: "plain"},
+		{name: "gzip", gzip: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tt.gzip {
+					w.Write([]byte(body))
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				zw := gzip.NewWriter(w)
+				zw.Write([]byte(body))
+				zw.Close()
+			}))
+			defer srv.Close()
+			cfg := loadTestConfig(t, "targets:\n  - url: "+srv.URL+"\n")
+			counter := scrapeBytesTotal.WithLabelValues(srv.URL)
+			before := counterValue(t, counter)
+
+			for i := 0; i < 2; i++ {
+				if _, err := fetchMetrics(context.Background(), cfg.Targets[0]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Bodies are counted once decompressed.
+			if got, want := counterValue(t, counter)-before, float64(2*len(body)); got != want {
+				t.Errorf("got %v bytes counted, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestServerName(t *testing.T) {
+	certPEM, keyPEM := testCert(t, "backend", []string{"backend.example"}, time.Now().Add(time.Hour))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sni := make(chan string, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE up gauge\nup 1\n")
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			// Only the first handshake of each fetch, retries aside, is
+			// checked.
+			select {
+			case sni <- hello.ServerName:
+			default:
+			}
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	// srv.URL has an IP address as host, which isn't sent for SNI and
+	// doesn't match the certificate.
+	tests := []struct {
+		name    string
+		config  string
+		wantSNI string
+		wantErr bool
+	}{
+		{
+			name:    "host",
+			config:  "{ca_file: " + caFile + "}",
+			wantErr: true,
+		},
+		{
+			name:    "server_name",
+			config:  "{ca_file: " + caFile + ", server_name: backend.example}",
+			wantSNI: "backend.example",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, "targets:\n  - url: "+srv.URL+"\n    tls_config: "+tt.config+"\n")
+
+			_, err := fetchMetrics(context.Background(), cfg.Targets[0])
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+			select {
+			case got := <-sni:
+				if got != tt.wantSNI {
+					t.Errorf("got SNI %q, want %q", got, tt.wantSNI)
+				}
+			default:
+				t.Error("got no TLS handshake")
+			}
+		})
+	}
+}
+
+func TestProxyAuth(t *testing.T) {
+	// proxy stands in for an authenticating forward proxy, answering plain
+	// HTTP requests itself rather than forwarding them.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "target.example" {
+			t.Errorf("got request for %q, want an absolute URL of target.example", r.URL)
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Error("got an Authorization header meant for the proxy")
+		}
+		req := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+		if user, pass, ok := req.BasicAuth(); !ok || user != "proxyuser" || pass != "proxypass" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		fmt.Fprint(w, "# TYPE up gauge\nup 1\n")
+	}))
+	defer proxy.Close()
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("proxypass\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{name: "password", config: "{username: proxyuser, password: proxypass}"},
+		{name: "password_file", config: "{username: proxyuser, password_file: " + passwordFile + "}"},
+		{name: "wrong password", config: "{username: proxyuser, password: wrong}", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, "targets:\n  - url: http://target.example/metrics\n    proxy_url: "+proxy.URL+"\n    proxy_auth: "+tt.config+"\n")
+
+			_, err := fetchMetrics(context.Background(), cfg.Targets[0])
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Invalid proxy credentials are rejected when the config is loaded.
+	for _, config := range []string{
+		"{password: proxypass}",
+		"{username: proxyuser, password: proxypass, password_file: " + passwordFile + "}",
+	} {
+		if _, err := loadConfig(writeTestConfig(t, "targets:\n  - url: http://target.example/metrics\n    proxy_url: "+proxy.URL+"\n    proxy_auth: "+config+"\n")); err == nil {
+			t.Errorf("got no error loading proxy_auth %s", config)
+		}
+	}
+}
+
+func TestSecretFileSwap(t *testing.T) {
+	// Secrets are mounted like Kubernetes does: the file is a symlink into
+	// ..data, itself a symlink to a directory of the current version, which
+	// is flipped to a new one on rotation.
+	dir := t.TempDir()
+	version := 0
+	// rotate writes secret as a new version and flips ..data to it.
+	rotate := func(secret string) {
+		t.Helper()
+		version++
+		name := fmt.Sprintf("..v%d", version)
+		if err := os.Mkdir(filepath.Join(dir, name), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "secret"), []byte(secret+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		tmp := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(name, tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate("initial")
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.Symlink(filepath.Join("..data", "secret"), secretFile); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config string
+		// secret returns the secret r was authenticated with.
+		secret func(r *http.Request) string
+	}{
+		{
+			name:   "bearer_token_file",
+			config: "bearer_token_file: " + secretFile,
+			secret: func(r *http.Request) string {
+				return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			},
+		},
+		{
+			name:   "password_file",
+			config: "basic_auth: {username: user, password_file: " + secretFile + "}",
+			secret: func(r *http.Request) string {
+				_, pass, _ := r.BasicAuth()
+				return pass
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = tt.secret(r)
+				fmt.Fprint(w, "# TYPE up gauge\nup 1\n")
+			}))
+			defer srv.Close()
+			cfg := loadTestConfig(t, "targets:\n  - url: "+srv.URL+"\n    "+tt.config+"\n")
+			// fetch checks that the target is scraped with want.
+			fetch := func(want string) {
+				t.Helper()
+				if _, err := fetchMetrics(context.Background(), cfg.Targets[0]); err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("got secret %q, want %q", got, want)
+				}
+			}
+
+			rotate(tt.name)
+			fetch(tt.name)
+			rotate(tt.name + " rotated")
+			fetch(tt.name + " rotated")
+
+			// A file briefly missing midway through a swap is waited for.
+			if err := os.Remove(secretFile); err != nil {
+				t.Fatal(err)
+			}
+			restored := time.AfterFunc(30*time.Millisecond, func() {
+				os.Symlink(filepath.Join("..data", "secret"), secretFile)
+			})
+			defer restored.Stop()
+			fetch(tt.name + " rotated")
+		})
+	}
+}
+
+func TestCertExpiry(t *testing.T) {
+	notAfter := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	certPEM, keyPEM := testCert(t, "target", nil, notAfter)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE up gauge\nup 1\n")
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+	cfg := loadTestConfig(t, "targets:\n  - url: "+srv.URL+"\n    tls_config: {insecure_skip_verify: true}\n")
+
+	if _, err := fetchMetrics(context.Background(), cfg.Targets[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := gaugeValue(t, targetCertExpiry.WithLabelValues(srv.URL)), float64(notAfter.Unix()); got != want {
+		t.Errorf("got expiry %v, want %v", got, want)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	t.Setenv("PUE_LOCALE", "de-CH")
+	t.Setenv("PUE_TENANT", "acme")
+	t.Setenv("PUE_BROKEN", "a\r\nX-Injected: 1")
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		fmt.Fprint(w, "# TYPE up gauge\nup 1\n")
+	}))
+	defer srv.Close()
+	cfg := loadTestConfig(t, "targets:\n  - url: "+srv.URL+"\n    headers:\n      Accept-Language: $PUE_LOCALE\n      X-Tenant: ${PUE_TENANT}-prod\n      X-Static: static\n")
+
+	if _, err := fetchMetrics(context.Background(), cfg.Targets[0]); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"Accept-Language": "de-CH", "X-Tenant": "acme-prod", "X-Static": "static"} {
+		if got := got.Get(name); got != want {
+			t.Errorf("got header %s %q, want %q", name, got, want)
+		}
+	}
+
+	// Headers are validated when the config is loaded.
+	for _, headers := range []string{
+		"{X-Tenant: $PUE_UNSET}",
+		"{X-Tenant: $PUE_BROKEN}",
+		"{\"Bad Name\": value}",
+	} {
+		if _, err := loadConfig(writeTestConfig(t, "targets:\n  - url: "+srv.URL+"\n    headers: "+headers+"\n")); err == nil {
+			t.Errorf("got no error loading headers %s", headers)
+		}
+	}
+}
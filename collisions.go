@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// collisions tracks which metric families are exposed by more than one
+// target. It's derived from the families each active target exposed when
+// last scraped successfully rather than from the results of a single
+// scrape, so that a target failing or being left out of a group scrape
+// doesn't change how the others are named.
+var collisions = struct {
+	sync.Mutex
+	// families is the names of the metric families each target exposed
+	// when last scraped successfully, by URL.
+	families map[string]map[string]bool
+	// exposedBy is the number of targets exposing each metric family, or
+	// nil if it needs recounting as families changed.
+	exposedBy map[string]int
+}{families: map[string]map[string]bool{}}
+
+// aliasCollisions renames the metric families of targets with a collision
+// prefix that are also exposed by other targets, so they are kept apart
+// rather than merged.
+func aliasCollisions(results []scrapeResult) {
+	exposedBy := collisionCounts(results)
+	for _, res := range results {
+		aliasFamilies(res.target, res.metricFamilies, exposedBy)
+	}
+}
+
+// aliasFamilies prepends the collision prefix of target t to the names of
+// its metric families exposed by more than one target according to
+// exposedBy.
+func aliasFamilies(t Target, metricFamilies map[string]*dto.MetricFamily, exposedBy map[string]int) {
+	if t.CollisionPrefix == "" {
+		return
+	}
+	var renamed []*dto.MetricFamily
+	for n, mf := range metricFamilies {
+		if exposedBy[n] > 1 {
+			delete(metricFamilies, n)
+			name := t.CollisionPrefix + n
+			mf.Name = &name
+			renamed = append(renamed, mf)
+		}
+	}
+	for _, mf := range renamed {
+		metricFamilies[mf.GetName()] = mf
+	}
+}
+
+// collisionCounts records the metric families of the successfully scraped
+// targets of results and returns the number of targets exposing each metric
+// family, recounted only if the families of a target changed.
+func collisionCounts(results []scrapeResult) map[string]int {
+	collisions.Lock()
+	defer collisions.Unlock()
+	for _, res := range results {
+		if res.err != nil {
+			continue
+		}
+		last := collisions.families[res.target.URL]
+		changed := last == nil || len(last) != len(res.metricFamilies)
+		names := make(map[string]bool, len(res.metricFamilies))
+		for n := range res.metricFamilies {
+			names[n] = true
+			if !last[n] {
+				changed = true
+			}
+		}
+		if changed {
+			collisions.families[res.target.URL] = names
+			collisions.exposedBy = nil
+		}
+	}
+	if collisions.exposedBy == nil {
+		collisions.exposedBy = map[string]int{}
+		for _, names := range collisions.families {
+			for n := range names {
+				collisions.exposedBy[n]++
+			}
+		}
+	}
+	return collisions.exposedBy
+}
+
+// pruneCollisions forgets the metric families of targets which are no
+// longer active.
+func pruneCollisions(active map[string]bool) {
+	collisions.Lock()
+	defer collisions.Unlock()
+	for u := range collisions.families {
+		if !active[u] {
+			delete(collisions.families, u)
+			collisions.exposedBy = nil
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ConsulSDConfig configures discovering targets from services registered in
+// Consul.
+type ConsulSDConfig struct {
+	// Server is the address of the Consul agent, by default taken from the
+	// CONSUL_HTTP_ADDR env var, or else http://127.0.0.1:8500.
+	Server string `yaml:"server"`
+	// Token is the ACL token to authenticate with, by default taken from the
+	// CONSUL_HTTP_TOKEN env var.
+	Token string `yaml:"token"`
+	// Datacenter is the datacenter to query, that of the agent by default.
+	Datacenter string `yaml:"datacenter"`
+	// Services lists the names of the services to discover instances of.
+	Services []string `yaml:"services"`
+	// Tags, if set, only discovers instances having all of them.
+	Tags            []string      `yaml:"tags"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// Scheme and MetricsPath are used to build the target URLs as with
+	// http_sd.
+	Scheme      string `yaml:"scheme"`
+	MetricsPath string `yaml:"metrics_path"`
+}
+
+// consulServiceEntry is an instance of a service as returned by the health
+// endpoint of the Consul API.
+type consulServiceEntry struct {
+	Node struct {
+		Node       string
+		Address    string
+		Datacenter string
+	}
+	Service struct {
+		Service string
+		Address string
+		Port    int
+	}
+}
+
+// consulSD keeps the set of targets discovered from Consul up to date.
+type consulSD struct {
+	cfg    ConsulSDConfig
+	client *http.Client
+	poller
+
+	mu sync.Mutex
+	// targets holds the targets last discovered for each service.
+	targets map[string][]Target
+}
+
+func newConsulSD(cfg ConsulSDConfig) *consulSD {
+	d := &consulSD{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.RefreshInterval},
+		targets: map[string][]Target{},
+	}
+	d.poller = newPoller(d, cfg.RefreshInterval)
+	return d
+}
+
+func (d *consulSD) config() interface{} {
+	return d.cfg
+}
+
+func (d *consulSD) source() string {
+	return "consul " + d.cfg.Server
+}
+
+func (d *consulSD) refresh() error {
+	var errs []error
+	for _, service := range d.cfg.Services {
+		targets, err := d.discover(service)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", service, err))
+			continue
+		}
+		targets = discoveredTargets(targets, d.source())
+		d.mu.Lock()
+		d.targets[service] = targets
+		d.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// discover returns the targets of the healthy instances of service.
+func (d *consulSD) discover(service string) ([]Target, error) {
+	q := url.Values{"passing": {"true"}}
+	for _, tag := range d.cfg.Tags {
+		q.Add("tag", tag)
+	}
+	if d.cfg.Datacenter != "" {
+		q.Set("dc", d.cfg.Datacenter)
+	}
+	req, err := http.NewRequest(http.MethodGet, d.cfg.Server+"/v1/health/service/"+url.PathEscape(service)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", d.cfg.Token)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	var targets []Target
+	for _, e := range entries {
+		// Services registered without an address are reached at the
+		// address of their node.
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		targets = append(targets, Target{
+			URL: d.cfg.Scheme + "://" + net.JoinHostPort(host, strconv.Itoa(e.Service.Port)) + d.cfg.MetricsPath,
+			Labels: map[string]string{
+				"service":    e.Service.Service,
+				"node":       e.Node.Node,
+				"datacenter": e.Node.Datacenter,
+			},
+		})
+	}
+	return targets, nil
+}
+
+// Targets returns the last discovered targets of the services.
+func (d *consulSD) Targets() []Target {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var targets []Target
+	for _, service := range d.cfg.Services {
+		targets = append(targets, d.targets[service]...)
+	}
+	return targets
+}
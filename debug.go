@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// handlePreview shows the metrics of the target given by the target query
+// parameter before and after being transformed and limited as when scraped,
+// along with the series that were dropped or rewritten on the way. Metric
+// families are listed in the order given by the sort query parameter, by name
+// by default.
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	order := byName
+	if s := r.URL.Query().Get("sort"); s != "" {
+		var ok bool
+		if order, ok = familyOrders[s]; !ok {
+			http.Error(w, "unknown sort order", http.StatusBadRequest)
+			return
+		}
+	}
+	url := r.URL.Query().Get("target")
+	var target *Target
+	for _, t := range activeTargets(currentConfig()) {
+		if t.URL == url {
+			target = &t
+			break
+		}
+	}
+	if target == nil {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return
+	}
+	metricFamilies, err := fetchMetrics(r.Context(), *target)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fetch metrics: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	// Transformations modify metrics in place, so take note of each series
+	// beforehand to find out what became of it.
+	before := map[*dto.Metric]string{}
+	for _, mf := range metricFamilies {
+		for _, m := range mf.Metric {
+			before[m] = seriesString(mf.GetName(), m)
+		}
+	}
+	var beforeText bytes.Buffer
+	if err := serializeMetrics(&beforeText, expfmt.FmtText, order, metricFamilies); err != nil {
+		http.Error(w, fmt.Sprintf("failed to serialize metrics: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// The metrics go through the same steps as when scraped, except for
+	// being merged with those of other targets and the limits hit being
+	// reported.
+	cfg := currentConfig()
+	metricFamilies, _, perr := limitMetrics(*target, metricFamilies)
+	aliasFamilies(*target, metricFamilies, collisionCounts(nil))
+	transformMerged(cfg, metricFamilies)
+	after := map[*dto.Metric]string{}
+	for _, mf := range metricFamilies {
+		for _, m := range mf.Metric {
+			after[m] = seriesString(mf.GetName(), m)
+		}
+	}
+	var dropped, rewritten []string
+	for m, b := range before {
+		if a, ok := after[m]; !ok {
+			dropped = append(dropped, b)
+		} else if a != b {
+			rewritten = append(rewritten, b+" => "+a)
+		}
+	}
+	sort.Strings(dropped)
+	sort.Strings(rewritten)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "# Before\n%s\n", beforeText.Bytes())
+	if perr != nil {
+		fmt.Fprintf(w, "# Dropped for exceeding a limit\n%v\n\n", perr)
+	}
+	fmt.Fprintf(w, "# After\n")
+	if err := serializeMetrics(w, expfmt.FmtText, order, metricFamilies); err != nil {
+		return
+	}
+	fmt.Fprintf(w, "\n# Dropped series\n")
+	for _, s := range dropped {
+		fmt.Fprintln(w, s)
+	}
+	fmt.Fprintf(w, "\n# Rewritten series\n")
+	for _, s := range rewritten {
+		fmt.Fprintln(w, s)
+	}
+}
+
+// seriesString returns the series identifier of m, as in name{k="v",...}
+// with labels sorted by name.
+func seriesString(name string, m *dto.Metric) string {
+	labels := make([]string, 0, len(m.Label))
+	for _, l := range m.Label {
+		labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+	}
+	sort.Strings(labels)
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// metadata is the type and help text of a metric family.
+type metadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+}
+
+var (
+	lastMetadataMu sync.Mutex
+	// lastMetadata is the metadata of the metric families served by the last
+	// scrape, keyed by family name.
+	lastMetadata = map[string][]metadata{}
+)
+
+// recordMetadata remembers the metadata of the served metric families for the
+// metadata endpoint.
+func recordMetadata(metricFamilies map[string]*dto.MetricFamily) {
+	md := make(map[string][]metadata, len(metricFamilies))
+	for n, mf := range metricFamilies {
+		md[n] = []metadata{{
+			Type: strings.ToLower(mf.GetType().String()),
+			Help: mf.GetHelp(),
+		}}
+	}
+	lastMetadataMu.Lock()
+	lastMetadata = md
+	lastMetadataMu.Unlock()
+}
+
+// handleMetadata lists the metric families served by the last scrape in the
+// same form as the Prometheus metadata API, optionally restricted to the
+// family given by the metric query parameter.
+func handleMetadata(w http.ResponseWriter, r *http.Request) {
+	lastMetadataMu.Lock()
+	md := lastMetadata
+	lastMetadataMu.Unlock()
+	if n := r.URL.Query().Get("metric"); n != "" {
+		m, ok := md[n]
+		md = map[string][]metadata{}
+		if ok {
+			md[n] = m
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   md,
+	})
+}
+
+// scrapeReport summarizes a scrape.
+type scrapeReport struct {
+	Time        time.Time      `json:"time"`
+	Duration    float64        `json:"duration_seconds"`
+	OutputBytes int64          `json:"output_bytes"`
+	Targets     []targetReport `json:"targets"`
+}
+
+// targetReport summarizes the scrape of a target.
+type targetReport struct {
+	URL      string  `json:"url"`
+	Up       bool    `json:"up"`
+	Duration float64 `json:"duration_seconds"`
+	Samples  int     `json:"samples"`
+	Error    string  `json:"error,omitempty"`
+}
+
+var (
+	lastReportMu sync.Mutex
+	// lastReport is the report of the last scrape, if any.
+	lastReport *scrapeReport
+)
+
+// recordReport remembers the summary of a scrape for the report endpoint.
+func recordReport(start time.Time, results []scrapeResult, outputBytes int64) {
+	report := &scrapeReport{
+		Time:        start,
+		Duration:    time.Since(start).Seconds(),
+		OutputBytes: outputBytes,
+	}
+	for _, res := range results {
+		tr := targetReport{
+			URL:      res.target.URL,
+			Up:       res.err == nil,
+			Duration: res.duration.Seconds(),
+			Samples:  countSamples(res.metricFamilies),
+		}
+		if res.err != nil {
+			tr.Error = res.err.Error()
+		}
+		report.Targets = append(report.Targets, tr)
+	}
+	sort.Slice(report.Targets, func(i, j int) bool {
+		return report.Targets[i].URL < report.Targets[j].URL
+	})
+	lastReportMu.Lock()
+	lastReport = report
+	lastReportMu.Unlock()
+}
+
+// handleReport summarizes the last scrape in plain text, or in JSON if the
+// format query parameter is json.
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	lastReportMu.Lock()
+	report := lastReport
+	lastReportMu.Unlock()
+	if report == nil {
+		http.Error(w, "no scrape yet", http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Scrape at %s took %.3fs and served %d bytes.\n\n",
+		report.Time.Format(time.RFC3339), report.Duration, report.OutputBytes)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tSTATUS\tDURATION\tSAMPLES\tERROR")
+	for _, t := range report.Targets {
+		status := "up"
+		if !t.Up {
+			status = "down"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.3fs\t%d\t%s\n", t.URL, status, t.Duration, t.Samples, t.Error)
+	}
+	tw.Flush()
+}
+
+// servePprof serves the profiling endpoints of net/http/pprof on addr,
+// separately from the main listener so that they aren't exposed along with
+// metrics.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	infof("serving pprof on http://%s/debug/pprof/", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// limitOutput caps the output of debug handler h to debug_output_limit
+// bytes, so that hitting it on a large fleet can't flood the client.
+func limitOutput(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig()
+		lw := &limitedResponseWriter{ResponseWriter: w, remaining: cfg.DebugOutputLimit}
+		h(lw, r)
+		if lw.truncated {
+			fmt.Fprintf(w, "\n... output truncated at %d bytes, see debug_output_limit\n", cfg.DebugOutputLimit)
+		}
+	}
+}
+
+// limitedResponseWriter writes through up to remaining bytes and silently
+// discards the rest.
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	remaining int64
+	truncated bool
+}
+
+func (w *limitedResponseWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= w.remaining {
+		n, err := w.ResponseWriter.Write(p)
+		w.remaining -= int64(n)
+		return n, err
+	}
+	w.truncated = true
+	n, err := w.ResponseWriter.Write(p[:w.remaining])
+	w.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return len(p), nil
+}
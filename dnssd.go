@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSSDConfig configures DNS service discovery, resolving records into
+// targets.
+type DNSSDConfig struct {
+	// Names lists the DNS names to resolve.
+	Names []string `yaml:"names"`
+	// Type is the type of records to resolve: SRV (default), A or AAAA.
+	Type string `yaml:"type"`
+	// Port is the port of the targets resolved from A and AAAA records. SRV
+	// records carry their own.
+	Port            int           `yaml:"port"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// Scheme and MetricsPath are used to build the target URLs as with
+	// http_sd.
+	Scheme      string `yaml:"scheme"`
+	MetricsPath string `yaml:"metrics_path"`
+}
+
+// dnsSD keeps the set of targets resolved from DNS records up to date.
+type dnsSD struct {
+	cfg DNSSDConfig
+	poller
+
+	mu sync.Mutex
+	// targets holds the targets last resolved from each name.
+	targets map[string][]Target
+}
+
+func newDNSSD(cfg DNSSDConfig) *dnsSD {
+	d := &dnsSD{
+		cfg:     cfg,
+		targets: map[string][]Target{},
+	}
+	d.poller = newPoller(d, cfg.RefreshInterval)
+	return d
+}
+
+func (d *dnsSD) config() interface{} {
+	return d.cfg
+}
+
+func (d *dnsSD) source() string {
+	return "dns " + strings.Join(d.cfg.Names, ", ")
+}
+
+func (d *dnsSD) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.RefreshInterval)
+	defer cancel()
+	var errs []error
+	for _, name := range d.cfg.Names {
+		addrs, err := d.resolve(ctx, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		groups := []targetGroup{{Targets: addrs}}
+		targets := discoveredTargets(groupTargets(groups, d.cfg.Scheme, d.cfg.MetricsPath, nil), name)
+		d.mu.Lock()
+		d.targets[name] = targets
+		d.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// resolve returns the host:port pairs name resolves to.
+func (d *dnsSD) resolve(ctx context.Context, name string) ([]string, error) {
+	var addrs []string
+	switch d.cfg.Type {
+	case "SRV":
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+	default:
+		network := "ip4"
+		if d.cfg.Type == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := net.DefaultResolver.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(d.cfg.Port)))
+		}
+	}
+	return addrs, nil
+}
+
+// Targets returns the targets last resolved from the names.
+func (d *dnsSD) Targets() []Target {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var targets []Target
+	for _, name := range d.cfg.Names {
+		targets = append(targets, d.targets[name]...)
+	}
+	return targets
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Labels of containers controlling whether and how they are scraped.
+const (
+	dockerScrapeLabel = "pue.scrape"
+	dockerPortLabel   = "pue.port"
+	dockerPathLabel   = "pue.path"
+	dockerSchemeLabel = "pue.scheme"
+)
+
+// DockerSDConfig configures discovering targets from the containers of a
+// Docker daemon labeled with pue.scrape=true.
+type DockerSDConfig struct {
+	// Host is the address of the Docker daemon, by default taken from the
+	// DOCKER_HOST env var, or else unix:///var/run/docker.sock.
+	Host string `yaml:"host"`
+	// Network is the network whose address of containers is scraped. By
+	// default, the first network of each container with an address is used.
+	Network         string        `yaml:"network"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// Scheme and MetricsPath are used to build the target URLs unless
+	// overridden by the pue.scheme and pue.path labels.
+	Scheme      string `yaml:"scheme"`
+	MetricsPath string `yaml:"metrics_path"`
+}
+
+// dockerContainer is a container as listed by the Docker API.
+type dockerContainer struct {
+	Names           []string
+	Image           string
+	Labels          map[string]string
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string
+		}
+	}
+}
+
+// dockerSD keeps the set of targets discovered from a Docker daemon up to
+// date.
+type dockerSD struct {
+	cfg    DockerSDConfig
+	client *http.Client
+	// base is the URL requests to the daemon are relative to.
+	base string
+	poller
+
+	mu      sync.Mutex
+	targets []Target
+}
+
+func newDockerSD(cfg DockerSDConfig) *dockerSD {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	base := cfg.Host
+	if path, ok := strings.CutPrefix(cfg.Host, "unix://"); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		base = "http://docker"
+	} else if addr, ok := strings.CutPrefix(cfg.Host, "tcp://"); ok {
+		base = "http://" + addr
+	}
+	d := &dockerSD{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport, Timeout: cfg.RefreshInterval},
+		base:   base,
+	}
+	d.poller = newPoller(d, cfg.RefreshInterval)
+	return d
+}
+
+func (d *dockerSD) config() interface{} {
+	return d.cfg
+}
+
+func (d *dockerSD) source() string {
+	return "docker " + d.cfg.Host
+}
+
+func (d *dockerSD) refresh() error {
+	filters := `{"label":["` + dockerScrapeLabel + `=true"]}`
+	resp, err := d.client.Get(d.base + "/containers/json?" + url.Values{"filters": {filters}}.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return err
+	}
+	var targets []Target
+	for _, c := range containers {
+		ip := d.address(c)
+		port, err := strconv.Atoi(c.Labels[dockerPortLabel])
+		if ip == "" || err != nil {
+			continue
+		}
+		scheme, path := d.cfg.Scheme, d.cfg.MetricsPath
+		if s := c.Labels[dockerSchemeLabel]; s != "" {
+			scheme = s
+		}
+		if p := c.Labels[dockerPathLabel]; p != "" {
+			path = p
+		}
+		name := ""
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		targets = append(targets, Target{
+			URL: scheme + "://" + net.JoinHostPort(ip, strconv.Itoa(port)) + path,
+			Labels: map[string]string{
+				"container": name,
+				"image":     c.Image,
+			},
+		})
+	}
+	targets = discoveredTargets(targets, d.source())
+	d.mu.Lock()
+	d.targets = targets
+	d.mu.Unlock()
+	return nil
+}
+
+// address returns the IP address of container c to scrape, or "" if it has
+// none on the configured network.
+func (d *dockerSD) address(c dockerContainer) string {
+	if d.cfg.Network != "" {
+		return c.NetworkSettings.Networks[d.cfg.Network].IPAddress
+	}
+	names := make([]string, 0, len(c.NetworkSettings.Networks))
+	for name := range c.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ip := c.NetworkSettings.Networks[name].IPAddress; ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+// Targets returns the last successfully discovered targets.
+func (d *dockerSD) Targets() []Target {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.targets
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileSDConfig configures Prometheus compatible file service discovery,
+// reading targets from JSON or YAML files of target groups.
+type FileSDConfig struct {
+	// Files lists glob patterns of the files to read. Relative patterns
+	// are relative to the directory of the config file.
+	Files []string `yaml:"files"`
+	// RefreshInterval is how often the files are checked for changes.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// Scheme and MetricsPath are used to build the target URLs as with
+	// http_sd.
+	Scheme      string `yaml:"scheme"`
+	MetricsPath string `yaml:"metrics_path"`
+}
+
+// fileSD keeps the set of targets read from files up to date.
+type fileSD struct {
+	cfg FileSDConfig
+	poller
+
+	mu sync.Mutex
+	// files holds the targets last read from each file, along with its
+	// modification time so that unchanged files aren't read again.
+	files   map[string]sdFile
+	targets []Target
+}
+
+// sdFile is the targets read from a file.
+type sdFile struct {
+	modTime time.Time
+	targets []Target
+}
+
+func newFileSD(cfg FileSDConfig) *fileSD {
+	d := &fileSD{
+		cfg:   cfg,
+		files: map[string]sdFile{},
+	}
+	d.poller = newPoller(d, cfg.RefreshInterval)
+	return d
+}
+
+func (d *fileSD) config() interface{} {
+	return d.cfg
+}
+
+func (d *fileSD) source() string {
+	return strings.Join(d.cfg.Files, ", ")
+}
+
+// refresh reads the files matching the patterns which changed since the last
+// refresh. Targets of files which fail to read are kept as last read, while
+// those of files which no longer exist are dropped.
+func (d *fileSD) refresh() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var paths []string
+	for _, pattern := range d.cfg.Files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+	var errs []error
+	files := map[string]sdFile{}
+	var targets []Target
+	for _, path := range paths {
+		if _, ok := files[path]; ok {
+			continue // matched by more than one pattern
+		}
+		f, err := d.readFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+		files[path] = f
+		targets = append(targets, f.targets...)
+	}
+	d.files = files
+	d.targets = targets
+	return errors.Join(errs...)
+}
+
+// readFile returns the targets of the file at path, as last read if it
+// didn't change or fails to read.
+func (d *fileSD) readFile(path string) (sdFile, error) {
+	last := d.files[path]
+	fi, err := os.Stat(path)
+	if err != nil {
+		return last, err
+	}
+	if fi.ModTime().Equal(last.modTime) {
+		return last, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return last, err
+	}
+	defer f.Close()
+	// JSON being a subset of YAML, both are read by the YAML decoder.
+	var groups []targetGroup
+	if err := yaml.NewDecoder(f).Decode(&groups); err != nil && err != io.EOF {
+		return last, err
+	}
+	return sdFile{
+		modTime: fi.ModTime(),
+		targets: discoveredTargets(groupTargets(groups, d.cfg.Scheme, d.cfg.MetricsPath, nil), path),
+	}, nil
+}
+
+// Targets returns the targets last read from the files.
+func (d *fileSD) Targets() []Target {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.targets
+}
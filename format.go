@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFormat, if set with the --config-format flag, is the format of
+// config files, overriding the one told by their extension.
+var configFormat string
+
+// readConfigFile returns a reader of the config file at path in YAML. The
+// file can be in YAML, JSON, which is read as is since it's a subset of
+// YAML, or TOML, which is converted to YAML.
+func readConfigFile(path string) (io.Reader, error) {
+	format := configFormat
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			format = "json"
+		case ".toml":
+			format = "toml"
+		default:
+			format = "yaml"
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "yaml", "json":
+		return bytes.NewReader(b), nil
+	case "toml":
+		var v map[string]interface{}
+		if err := toml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		y, err := yaml.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(y), nil
+	default:
+		return nil, fmt.Errorf("unknown config format %q", format)
+	}
+}
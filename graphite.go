@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// GraphiteConfig configures serving metrics in the Graphite plaintext format.
+type GraphiteConfig struct {
+	// Path is the endpoint serving the metrics, /graphite by default.
+	Path string `yaml:"path"`
+	// Naming is how metric names and labels are mangled into Graphite paths:
+	//
+	//   - dotted appends label names and values as path components, as in
+	//     name.label1.value1.label2.value2 (default)
+	//   - tagged uses Graphite tags, as in name;label1=value1;label2=value2
+	Naming string `yaml:"naming"`
+	// Prefix is prepended to every path, e.g. "pue." to group all metrics.
+	Prefix string `yaml:"prefix"`
+}
+
+// handleGraphite collates metrics from all targets and writes them to the
+// response in the Graphite plaintext format.
+func handleGraphite(w http.ResponseWriter, r *http.Request) {
+	g := currentConfig().Graphite
+	if g == nil {
+		// Disabled by a config reload.
+		http.NotFound(w, r)
+		return
+	}
+	allMetricsFamilies, _, scrapeTime := gatherMetrics(r.Context(), "")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	if err := writeGraphite(bw, allMetricsFamilies, g, scrapeTime); err != nil {
+		warnf("failed to write graphite metrics: %v", err)
+		return
+	}
+	if err := bw.Flush(); err != nil {
+		warnf("failed to write graphite metrics: %v", err)
+	}
+}
+
+// writeGraphite writes the metric families to w as Graphite plaintext lines,
+// one per sample. Samples without a timestamp are given ts.
+func writeGraphite(w io.Writer, metricFamilies map[string]*dto.MetricFamily, gc *GraphiteConfig, ts time.Time) error {
+	names := make([]string, 0, len(metricFamilies))
+	for n := range metricFamilies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		mf := metricFamilies[n]
+		for _, m := range mf.Metric {
+			t := ts.Unix()
+			if m.TimestampMs != nil {
+				t = *m.TimestampMs / 1000
+			}
+			line := func(suffix string, v float64, extra ...string) error {
+				_, err := fmt.Fprintf(w, "%s %s %d\n", graphitePath(gc, n+suffix, m.Label, extra...), formatGraphiteValue(v), t)
+				return err
+			}
+			var err error
+			switch {
+			case m.Counter != nil:
+				err = line("", m.Counter.GetValue())
+			case m.Gauge != nil:
+				err = line("", m.Gauge.GetValue())
+			case m.Untyped != nil:
+				err = line("", m.Untyped.GetValue())
+			case m.Summary != nil:
+				for _, q := range m.Summary.Quantile {
+					if err = line("", q.GetValue(), "quantile", formatGraphiteValue(q.GetQuantile())); err != nil {
+						return err
+					}
+				}
+				if err = line("_sum", m.Summary.GetSampleSum()); err != nil {
+					return err
+				}
+				err = line("_count", float64(m.Summary.GetSampleCount()))
+			case m.Histogram != nil:
+				hasInf := false
+				for _, b := range m.Histogram.Bucket {
+					hasInf = hasInf || math.IsInf(b.GetUpperBound(), 1)
+					if err = line("_bucket", float64(b.GetCumulativeCount()), "le", formatGraphiteValue(b.GetUpperBound())); err != nil {
+						return err
+					}
+				}
+				if !hasInf {
+					if err = line("_bucket", float64(m.Histogram.GetSampleCount()), "le", "+Inf"); err != nil {
+						return err
+					}
+				}
+				if err = line("_sum", m.Histogram.GetSampleSum()); err != nil {
+					return err
+				}
+				err = line("_count", float64(m.Histogram.GetSampleCount()))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// graphiteUnsafe matches the characters replaced in Graphite path components.
+var graphiteUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_:+-]`)
+
+// graphitePath returns the Graphite path of the sample with the given name
+// and labels, plus extra label name and value pairs.
+func graphitePath(gc *GraphiteConfig, name string, labels []*dto.LabelPair, extra ...string) string {
+	pairs := make([][2]string, 0, len(labels)+len(extra)/2)
+	for _, l := range labels {
+		pairs = append(pairs, [2]string{l.GetName(), l.GetValue()})
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, [2]string{extra[i], extra[i+1]})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	var b strings.Builder
+	b.WriteString(gc.Prefix)
+	b.WriteString(name)
+	for _, p := range pairs {
+		if gc.Naming == "tagged" {
+			// Tag values may contain anything but ; and ~ and be non-empty.
+			v := strings.NewReplacer(";", "_", "~", "_").Replace(p[1])
+			if v == "" {
+				continue
+			}
+			fmt.Fprintf(&b, ";%s=%s", p[0], v)
+		} else {
+			fmt.Fprintf(&b, ".%s.%s", p[0], graphiteUnsafe.ReplaceAllString(p[1], "_"))
+		}
+	}
+	return b.String()
+}
+
+func formatGraphiteValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Group is a named group of targets, whose metrics are also served on their
+// own at /metrics/<name>.
+type Group struct {
+	Name string `yaml:"name"`
+	// Labels are added to the labels of each target of the group, unless
+	// the target sets them itself.
+	Labels map[string]string `yaml:"labels"`
+	// RelabelConfigs are applied to each target of the group before its
+	// own.
+	RelabelConfigs []RelabelConfig `yaml:"relabel_configs"`
+	Targets        []Target        `yaml:"targets"`
+}
+
+// groupName matches valid group names, which are used as path segments.
+var groupName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// expandGroups returns the targets of the groups, with the labels of their
+// group and marked as belonging to it.
+func expandGroups(groups []Group) ([]Target, error) {
+	var targets []Target
+	seen := map[string]bool{}
+	for i, g := range groups {
+		if !groupName.MatchString(g.Name) {
+			return nil, fmt.Errorf("group #%d: invalid name %q", i+1, g.Name)
+		}
+		if seen[g.Name] {
+			return nil, fmt.Errorf("group #%d: duplicate name %q", i+1, g.Name)
+		}
+		seen[g.Name] = true
+		for _, t := range g.Targets {
+			t.Labels = mergeLabels(g.Labels, t.Labels)
+			t.RelabelConfigs = append(append([]RelabelConfig(nil), g.RelabelConfigs...), t.RelabelConfigs...)
+			t.group = g.Name
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// hasGroup reports whether the config has a group with the given name.
+func (c *Config) hasGroup(name string) bool {
+	for _, g := range c.Groups {
+		if g.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// groupResults returns the results of the targets of the group, or all
+// results if group is empty.
+func groupResults(results []scrapeResult, group string) []scrapeResult {
+	if group == "" {
+		return results
+	}
+	var filtered []scrapeResult
+	for _, res := range results {
+		if res.target.group == group {
+			filtered = append(filtered, res)
+		}
+	}
+	return filtered
+}
+
+// mergeGroups merges the metrics of the targets of each group on their own.
+// The metrics of results are cloned, as merging modifies them.
+func mergeGroups(cfg *Config, results []scrapeResult) map[string]map[string]*dto.MetricFamily {
+	merged := make(map[string]map[string]*dto.MetricFamily, len(cfg.Groups))
+	for _, g := range cfg.Groups {
+		var clones []scrapeResult
+		for _, res := range groupResults(results, g.Name) {
+			res.metricFamilies = cloneMetricFamilies(res.metricFamilies)
+			clones = append(clones, res)
+		}
+		merged[g.Name] = mergeResults(cfg, clones, g.Name)
+	}
+	return merged
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// handleHealthy reports the exporter as alive, for liveness probes.
+func handleHealthy(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "healthy")
+}
+
+// handleReady reports the exporter as ready. With the check=targets query
+// parameter, it additionally probes all targets and only reports ready if
+// at least ready_min_targets of them are reachable.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("check") != "targets" {
+		fmt.Fprintln(w, "ready")
+		return
+	}
+	cfg := currentConfig()
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.ReadyProbeTimeout)
+	defer cancel()
+	targets := activeTargets(cfg)
+	ch := make(chan bool, len(targets))
+	for _, t := range targets {
+		go func(t Target) {
+			ch <- probeTarget(ctx, t) == nil
+		}(t)
+	}
+	reachable := 0
+	for range targets {
+		if <-ch {
+			reachable++
+		}
+	}
+	if reachable < cfg.ReadyMinTargets {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, "%d/%d targets reachable, %d required\n", reachable, len(targets), cfg.ReadyMinTargets)
+}
+
+// probeTarget checks whether target t responds successfully, without
+// reading its metrics.
+func probeTarget(ctx context.Context, t Target) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.URL, nil)
+	if err != nil {
+		return err
+	}
+	if err := t.prepareRequest(req); err != nil {
+		return err
+	}
+	resp, err := t.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
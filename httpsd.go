@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTPSDConfig configures a Prometheus compatible HTTP service discovery
+// endpoint to periodically fetch targets from.
+type HTTPSDConfig struct {
+	URL             string        `yaml:"url"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// Scheme and MetricsPath are used to build the target URLs from the
+	// discovered host:port pairs, unless overridden by the __scheme__ and
+	// __metrics_path__ labels of a target group.
+	Scheme      string `yaml:"scheme"`
+	MetricsPath string `yaml:"metrics_path"`
+	// SampleSize, if positive, limits each scrape to that many of the
+	// discovered targets, rotating through all of them over successive
+	// scrapes. This trades completeness for less load on large sets of
+	// identical replicas.
+	SampleSize int `yaml:"sample_size"`
+	// DropLabels lists target group labels not to add to the metrics of the
+	// discovered targets.
+	DropLabels []string `yaml:"drop_labels"`
+}
+
+// httpSD keeps the set of targets discovered through an HTTP service
+// discovery endpoint up to date.
+type httpSD struct {
+	cfg    HTTPSDConfig
+	client *http.Client
+	poller
+
+	mu      sync.Mutex
+	targets []Target
+	// next is the index of the first target of the next sample.
+	next int
+	// sampled is the URLs of the targets included in the last sample.
+	sampled []string
+}
+
+func newHTTPSD(cfg HTTPSDConfig) *httpSD {
+	d := &httpSD{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.RefreshInterval},
+	}
+	d.poller = newPoller(d, cfg.RefreshInterval)
+	return d
+}
+
+func (d *httpSD) config() interface{} {
+	return d.cfg
+}
+
+func (d *httpSD) source() string {
+	return d.cfg.URL
+}
+
+func (d *httpSD) refresh() error {
+	resp, err := d.client.Get(d.cfg.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var groups []targetGroup
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return err
+	}
+	targets := discoveredTargets(groupTargets(groups, d.cfg.Scheme, d.cfg.MetricsPath, d.cfg.DropLabels), d.source())
+	d.mu.Lock()
+	d.targets = targets
+	d.mu.Unlock()
+	return nil
+}
+
+// Targets returns the last successfully discovered targets.
+func (d *httpSD) Targets() []Target {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.targets
+}
+
+// Sample returns the targets to scrape this time around, which is all of them
+// unless a sample size is configured, in which case the next sample_size
+// targets in rotation are returned.
+func (d *httpSD) Sample() []Target {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cfg.SampleSize <= 0 {
+		return d.targets
+	}
+	sample := d.targets
+	if d.cfg.SampleSize < len(d.targets) {
+		sample = make([]Target, 0, d.cfg.SampleSize)
+		for i := 0; i < d.cfg.SampleSize; i++ {
+			sample = append(sample, d.targets[(d.next+i)%len(d.targets)])
+		}
+		d.next = (d.next + d.cfg.SampleSize) % len(d.targets)
+	}
+
+	for _, u := range d.sampled {
+		targetSampled.DeleteLabelValues(u)
+	}
+	d.sampled = d.sampled[:0]
+	for _, t := range d.targets {
+		targetSampled.WithLabelValues(t.URL).Set(0)
+		d.sampled = append(d.sampled, t.URL)
+	}
+	for _, t := range sample {
+		targetSampled.WithLabelValues(t.URL).Set(1)
+	}
+	return sample
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHTTPSDRefresh(t *testing.T) {
+	previous := discoveredTargets([]Target{{URL: "http://10.0.0.9:9100/metrics", Labels: map[string]string{}}}, "test")
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		dropLabels []string
+		want       []Target
+		wantErr    bool
+	}{
+		{
+			name: "groups",
+			body: `[
+				{"targets": ["10.0.0.1:9100", "10.0.0.2:9100"], "labels": {"env": "prod"}},
+				{"targets": ["10.0.0.3:9100"]}
+			]`,
+			want: []Target{
+				{URL: "http://10.0.0.1:9100/metrics", Labels: map[string]string{"env": "prod"}},
+				{URL: "http://10.0.0.2:9100/metrics", Labels: map[string]string{"env": "prod"}},
+				{URL: "http://10.0.0.3:9100/metrics", Labels: map[string]string{}},
+			},
+		},
+		{
+			name: "scheme and path overridden",
+			body: `[{"targets": ["db:9187"], "labels": {"__scheme__": "https", "__metrics_path__": "/pg", "__meta_x": "y", "job": "pg"}}]`,
+			want: []Target{
+				{URL: "https://db:9187/pg", Labels: map[string]string{"job": "pg"}},
+			},
+		},
+		{
+			name:       "dropped labels",
+			body:       `[{"targets": ["10.0.0.1:9100"], "labels": {"env": "prod", "datacenter": "eu1"}}]`,
+			dropLabels: []string{"datacenter"},
+			want: []Target{
+				{URL: "http://10.0.0.1:9100/metrics", Labels: map[string]string{"env": "prod"}},
+			},
+		},
+		{
+			name: "invalid label name",
+			body: `[{"targets": ["10.0.0.1:9100"], "labels": {"env": "prod", "foo-bar": "x"}}]`,
+			want: []Target{
+				{URL: "http://10.0.0.1:9100/metrics", Labels: map[string]string{"env": "prod"}},
+			},
+		},
+		{
+			name: "invalid scheme",
+			body: `[
+				{"targets": ["10.0.0.1:9100"], "labels": {"__scheme__": "ftp"}},
+				{"targets": ["10.0.0.2:9100"]}
+			]`,
+			want: []Target{
+				{URL: "http://10.0.0.2:9100/metrics", Labels: map[string]string{}},
+			},
+		},
+		{
+			name: "no groups",
+			body: `[]`,
+		},
+		{
+			name:    "endpoint down",
+			status:  http.StatusServiceUnavailable,
+			want:    previous,
+			wantErr: true,
+		},
+		{
+			name:    "invalid JSON",
+			body:    `{"targets": "10.0.0.1:9100"}`,
+			want:    previous,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			d := newHTTPSD(HTTPSDConfig{
+				URL:             srv.URL,
+				RefreshInterval: time.Second,
+				Scheme:          "http",
+				MetricsPath:     "/metrics",
+				DropLabels:      tt.dropLabels,
+			})
+			d.targets = previous
+
+			err := d.refresh()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			got := d.Targets()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got targets %v, want %v", got, tt.want)
+			}
+			for i, target := range got {
+				if target.URL != tt.want[i].URL || !reflect.DeepEqual(target.Labels, tt.want[i].Labels) {
+					t.Errorf("got target %s %v, want %s %v", target.URL, target.Labels, tt.want[i].URL, tt.want[i].Labels)
+				}
+				// Discovered targets get the defaults static ones get.
+				if target.RetryBackoff != 100*time.Millisecond || target.BreakerCooldown != time.Minute {
+					t.Errorf("target %s: got retry_backoff %v and breaker_cooldown %v, want defaults", target.URL, target.RetryBackoff, target.BreakerCooldown)
+				}
+				if want := serializeLabels(target.Labels); target.labelsSerialized != want {
+					t.Errorf("target %s: got serialized labels %q, want %q", target.URL, target.labelsSerialized, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPSDSample(t *testing.T) {
+	d := newHTTPSD(HTTPSDConfig{URL: "http://127.0.0.1:8000/targets", SampleSize: 2})
+	for i := 0; i < 5; i++ {
+		d.targets = append(d.targets, Target{URL: "http://10.0.0." + strconv.Itoa(i) + ":9100/metrics"})
+	}
+	// Samples rotate through all targets, wrapping around.
+	for _, want := range [][]int{{0, 1}, {2, 3}, {4, 0}, {1, 2}} {
+		sampled := map[string]bool{}
+		var got []int
+		for _, target := range d.Sample() {
+			sampled[target.URL] = true
+			for i, dt := range d.targets {
+				if dt.URL == target.URL {
+					got = append(got, i)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got sample %v, want %v", got, want)
+		}
+		for _, dt := range d.targets {
+			want := 0.0
+			if sampled[dt.URL] {
+				want = 1
+			}
+			if got := gaugeValue(t, targetSampled.WithLabelValues(dt.URL)); got != want {
+				t.Errorf("got pue_target_sampled %v for %s, want %v", got, dt.URL, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// include is the content of a file included by the config.
+type include struct {
+	Targets []Target `yaml:"targets"`
+}
+
+// includedFiles returns the files matching the include patterns of the config
+// at configPath, in a stable order.
+func includedFiles(configPath string, patterns []string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configPath), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// loadInclude loads an included file. If strict, unknown fields are errors.
+func loadInclude(path string, strict bool) (*include, error) {
+	f, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var inc include
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(strict)
+	// An empty file is fine, e.g. a team with no targets yet.
+	if err := dec.Decode(&inc); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if strict {
+		if err := checkTargetFields(inc.Targets); err != nil {
+			return nil, err
+		}
+	}
+	return &inc, nil
+}
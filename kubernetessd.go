@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Annotations of pods and services controlling whether and how they are
+// scraped, as commonly used with Prometheus.
+const (
+	scrapeAnnotation = "prometheus.io/scrape"
+	portAnnotation   = "prometheus.io/port"
+	pathAnnotation   = "prometheus.io/path"
+	schemeAnnotation = "prometheus.io/scheme"
+)
+
+// serviceAccountDir holds the credentials of the service account of the pod
+// the exporter runs in.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+// KubernetesSDConfig configures discovering targets from the Kubernetes API.
+// Only pods, services or endpoints annotated with prometheus.io/scrape: "true"
+// become targets.
+type KubernetesSDConfig struct {
+	// Role is the kind of object to discover: pod (default), service or
+	// endpoints.
+	Role string `yaml:"role"`
+	// Namespaces lists the namespaces to discover in, all by default.
+	Namespaces []string `yaml:"namespaces"`
+	// LabelSelector, if set, only discovers objects matching it, e.g.
+	// app=api,tier!=canary.
+	LabelSelector   string        `yaml:"label_selector"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// APIServer is the address of the API server. By default, the exporter
+	// is assumed to run in the cluster and the API server, token and CA of
+	// its service account are used.
+	APIServer       string `yaml:"api_server"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+	CAFile          string `yaml:"ca_file"`
+	// Scheme and MetricsPath are used to build the target URLs unless
+	// overridden by the prometheus.io/scheme and prometheus.io/path
+	// annotations.
+	Scheme      string `yaml:"scheme"`
+	MetricsPath string `yaml:"metrics_path"`
+}
+
+// kubeMeta is the metadata of a Kubernetes object.
+type kubeMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type kubePod struct {
+	Metadata kubeMeta `json:"metadata"`
+	Spec     struct {
+		Containers []struct {
+			Ports []struct {
+				ContainerPort int `json:"containerPort"`
+			} `json:"ports"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+type kubeService struct {
+	Metadata kubeMeta `json:"metadata"`
+	Spec     struct {
+		Ports []struct {
+			Port int `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+type kubeEndpoints struct {
+	Metadata kubeMeta `json:"metadata"`
+	Subsets  []struct {
+		Addresses []struct {
+			IP        string `json:"ip"`
+			TargetRef *struct {
+				Kind string `json:"kind"`
+				Name string `json:"name"`
+			} `json:"targetRef"`
+		} `json:"addresses"`
+		Ports []struct {
+			Port int `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// kubernetesSD keeps the set of targets discovered from the Kubernetes API
+// up to date.
+type kubernetesSD struct {
+	cfg KubernetesSDConfig
+	poller
+
+	mu      sync.Mutex
+	client  *http.Client
+	targets []Target
+}
+
+func newKubernetesSD(cfg KubernetesSDConfig) *kubernetesSD {
+	d := &kubernetesSD{cfg: cfg}
+	d.poller = newPoller(d, cfg.RefreshInterval)
+	return d
+}
+
+func (d *kubernetesSD) config() interface{} {
+	return d.cfg
+}
+
+func (d *kubernetesSD) source() string {
+	return "kubernetes " + d.cfg.Role + "s"
+}
+
+// httpClient returns the client to talk to the API server with, creating it
+// on first use so that a missing CA file is retried on the next refresh.
+func (d *kubernetesSD) httpClient() (*http.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if d.cfg.CAFile != "" {
+		pool, err := loadCertPool(d.cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	d.client = &http.Client{Transport: transport, Timeout: d.cfg.RefreshInterval}
+	return d.client, nil
+}
+
+// list lists the objects of kind, e.g. pods, in all configured namespaces
+// into items, a pointer to a slice.
+func (d *kubernetesSD) list(kind string, items interface{}) error {
+	client, err := d.httpClient()
+	if err != nil {
+		return err
+	}
+	token := ""
+	if d.cfg.BearerTokenFile != "" {
+		// Service account tokens are rotated, so the file is read anew.
+		if token, err = readSecretFile(d.cfg.BearerTokenFile); err != nil {
+			return err
+		}
+	}
+	var paths []string
+	if len(d.cfg.Namespaces) == 0 {
+		paths = []string{"/api/v1/" + kind}
+	}
+	for _, ns := range d.cfg.Namespaces {
+		paths = append(paths, "/api/v1/namespaces/"+url.PathEscape(ns)+"/"+kind)
+	}
+	var all []json.RawMessage
+	for _, path := range paths {
+		u := d.cfg.APIServer + path
+		if d.cfg.LabelSelector != "" {
+			u += "?" + url.Values{"labelSelector": {d.cfg.LabelSelector}}.Encode()
+		}
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		var list struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s: unexpected status %s", path, resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&list)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		all = append(all, list.Items...)
+	}
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, items)
+}
+
+func (d *kubernetesSD) refresh() error {
+	var targets []Target
+	switch d.cfg.Role {
+	case "pod":
+		var pods []kubePod
+		if err := d.list("pods", &pods); err != nil {
+			return err
+		}
+		for _, p := range pods {
+			if p.Status.Phase != "Running" || p.Status.PodIP == "" {
+				continue
+			}
+			port := 0
+			for _, c := range p.Spec.Containers {
+				for _, cp := range c.Ports {
+					if port == 0 {
+						port = cp.ContainerPort
+					}
+				}
+			}
+			if t, ok := d.target(p.Metadata, p.Status.PodIP, port); ok {
+				t.Labels["pod"] = p.Metadata.Name
+				targets = append(targets, t)
+			}
+		}
+	case "service":
+		var services []kubeService
+		if err := d.list("services", &services); err != nil {
+			return err
+		}
+		for _, s := range services {
+			port := 0
+			if len(s.Spec.Ports) > 0 {
+				port = s.Spec.Ports[0].Port
+			}
+			host := s.Metadata.Name + "." + s.Metadata.Namespace + ".svc"
+			if t, ok := d.target(s.Metadata, host, port); ok {
+				t.Labels["service"] = s.Metadata.Name
+				targets = append(targets, t)
+			}
+		}
+	case "endpoints":
+		// Endpoints are annotated through their service, like Prometheus
+		// does with prometheus.io/scrape on services.
+		var services []kubeService
+		if err := d.list("services", &services); err != nil {
+			return err
+		}
+		annotations := map[string]map[string]string{}
+		for _, s := range services {
+			annotations[s.Metadata.Namespace+"/"+s.Metadata.Name] = s.Metadata.Annotations
+		}
+		var endpoints []kubeEndpoints
+		if err := d.list("endpoints", &endpoints); err != nil {
+			return err
+		}
+		for _, e := range endpoints {
+			meta := e.Metadata
+			meta.Annotations = annotations[meta.Namespace+"/"+meta.Name]
+			for _, s := range e.Subsets {
+				port := 0
+				if len(s.Ports) > 0 {
+					port = s.Ports[0].Port
+				}
+				for _, a := range s.Addresses {
+					t, ok := d.target(meta, a.IP, port)
+					if !ok {
+						continue
+					}
+					t.Labels["service"] = meta.Name
+					if a.TargetRef != nil && a.TargetRef.Kind == "Pod" {
+						t.Labels["pod"] = a.TargetRef.Name
+					}
+					targets = append(targets, t)
+				}
+			}
+		}
+	}
+	targets = discoveredTargets(targets, d.source())
+	d.mu.Lock()
+	d.targets = targets
+	d.mu.Unlock()
+	return nil
+}
+
+// target returns the target of an object at host, if it's annotated to be
+// scraped and a port is known, either from its annotations or as given.
+func (d *kubernetesSD) target(meta kubeMeta, host string, port int) (Target, bool) {
+	a := meta.Annotations
+	if a[scrapeAnnotation] != "true" {
+		return Target{}, false
+	}
+	if p, err := strconv.Atoi(a[portAnnotation]); err == nil {
+		port = p
+	}
+	if port <= 0 {
+		return Target{}, false
+	}
+	scheme, path := d.cfg.Scheme, d.cfg.MetricsPath
+	if s := a[schemeAnnotation]; s != "" {
+		scheme = s
+	}
+	if p := a[pathAnnotation]; p != "" {
+		path = p
+	}
+	return Target{
+		URL:    scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port)) + path,
+		Labels: map[string]string{"namespace": meta.Namespace},
+	}, true
+}
+
+// Targets returns the last successfully discovered targets.
+func (d *kubernetesSD) Targets() []Target {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.targets
+}
+
+// inClusterAPIServer returns the address of the API server of the cluster the
+// exporter runs in, if any.
+func inClusterAPIServer() (string, bool) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", false
+	}
+	return "https://" + net.JoinHostPort(host, port), true
+}
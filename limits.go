@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// labelLimitError returns why series m violates the label limits of target
+// t, or nil if it doesn't.
+func labelLimitError(t Target, name string, m *dto.Metric) error {
+	if t.LabelLimit > 0 && len(m.Label) > t.LabelLimit {
+		return fmt.Errorf("series of %s has %d labels, over label_limit of %d", name, len(m.Label), t.LabelLimit)
+	}
+	for _, l := range m.Label {
+		if t.LabelNameLengthLimit > 0 && len(l.GetName()) > t.LabelNameLengthLimit {
+			return fmt.Errorf("label %s of %s is longer than label_name_length_limit of %d", l.GetName(), name, t.LabelNameLengthLimit)
+		}
+		if t.LabelValueLengthLimit > 0 && len(l.GetValue()) > t.LabelValueLengthLimit {
+			return fmt.Errorf("value of label %s of %s is longer than label_value_length_limit of %d", l.GetName(), name, t.LabelValueLengthLimit)
+		}
+	}
+	return nil
+}
+
+// enforceLabelLimits checks the series of target t against its label limits.
+// Offending series are dropped if its label_limit_action is drop_series,
+// returning the first violation. Otherwise, the first violation is returned
+// as soon as found, for the whole target to be dropped.
+func enforceLabelLimits(t Target, metricFamilies map[string]*dto.MetricFamily) error {
+	var first error
+	for n, mf := range metricFamilies {
+		kept := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			err := labelLimitError(t, n, m)
+			if err == nil {
+				kept = append(kept, m)
+				continue
+			}
+			if t.LabelLimitAction != "drop_series" {
+				return err
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		mf.Metric = kept
+		if len(mf.Metric) == 0 {
+			delete(metricFamilies, n)
+		}
+	}
+	return first
+}
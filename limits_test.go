@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func TestLabelLimits(t *testing.T) {
+	const input = `# TYPE a gauge
+a{x="1"} 1
+a{x="1",y="2"} 2
+# TYPE b gauge
+b{a_rather_long_label_name="1"} 3
+# TYPE c gauge
+c{x="a rather long label value"} 4
+`
+	tests := []struct {
+		name    string
+		config  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "within",
+			config: "label_limit: 2\nlabel_name_length_limit: 30\nlabel_value_length_limit: 30",
+			want:   input,
+		},
+		{
+			name:    "label_limit",
+			config:  "label_limit: 1",
+			wantErr: true,
+		},
+		{
+			name:    "label_name_length_limit",
+			config:  "label_name_length_limit: 10",
+			wantErr: true,
+		},
+		{
+			name:    "label_value_length_limit",
+			config:  "label_value_length_limit: 10",
+			wantErr: true,
+		},
+		{
+			name:    "added labels count",
+			config:  "label_limit: 2\nlabels:\n  env: prod",
+			wantErr: true,
+		},
+		{
+			name:   "drop_series label_limit",
+			config: "label_limit: 1\nlabel_limit_action: drop_series",
+			want: `# TYPE a gauge
+a{x="1"} 1
+# TYPE b gauge
+b{a_rather_long_label_name="1"} 3
+# TYPE c gauge
+c{x="a rather long label value"} 4
+`,
+		},
+		{
+			name:   "drop_series label_name_length_limit",
+			config: "label_name_length_limit: 10\nlabel_limit_action: drop_series",
+			want: `# TYPE a gauge
+a{x="1"} 1
+a{x="1",y="2"} 2
+# TYPE c gauge
+c{x="a rather long label value"} 4
+`,
+		},
+		{
+			name:   "drop_series label_value_length_limit",
+			config: "label_value_length_limit: 10\nlabel_limit_action: drop_series",
+			want: `# TYPE a gauge
+a{x="1"} 1
+a{x="1",y="2"} 2
+# TYPE b gauge
+b{a_rather_long_label_name="1"} 3
+`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			target := testTarget(t, tt.config)
+			mfs, err := processMetrics(target, parseText(t, input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if got := formatText(t, mfs); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelLimitActionUnknown(t *testing.T) {
+	path := writeTestConfig(t, "targets:\n  - url: http://127.0.0.1:9100/metrics\n    label_limit_action: drop_label\n")
+	if _, err := loadConfig(path); err == nil {
+		t.Error("got no error for an unknown label_limit_action")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// logLevel is the severity of log messages. Errors are logged with
+// log.Printf directly, as they are always logged.
+type logLevel int
+
+const (
+	levelInfo logLevel = iota
+	levelWarn
+	levelError
+)
+
+// logLevels maps the names of log levels to them.
+var logLevels = map[string]logLevel{
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// minLogLevel is the level below which messages aren't logged.
+var minLogLevel = levelInfo
+
+// setLogLevel sets the level below which messages aren't logged by name.
+func setLogLevel(name string) error {
+	level, ok := logLevels[name]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", name)
+	}
+	minLogLevel = level
+	return nil
+}
+
+// infof logs an informational message, e.g. about the lifecycle of the
+// exporter.
+func infof(format string, args ...interface{}) {
+	if minLogLevel <= levelInfo {
+		log.Printf(format, args...)
+	}
+}
+
+// warnf logs a message about a problem which doesn't prevent the exporter
+// from working, e.g. a target being down.
+func warnf(format string, args ...interface{}) {
+	if minLogLevel <= levelWarn {
+		log.Printf(format, args...)
+	}
+}
@@ -1,132 +1,1590 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v3"
 )
 
 // Target is a Prometheus exporter target.
 type Target struct {
-	URL    string            `yaml:"url"`
+	URL string `yaml:"url"`
+	// Labels are added to the metrics of the target. A label is given either
+	// as its value, or as a mapping of its value and applies_to, a regex
+	// scoping it to the metric families whose name fully matches it.
 	Labels map[string]string `yaml:"labels"`
+	// If and Unless are conditions on env vars deciding whether the target
+	// is included, evaluated when the config is loaded. A condition is
+	// either NAME, true when the env var is set to a non-empty value, or
+	// NAME=VALUE, true when the env var is set to exactly VALUE.
+	If     string `yaml:"if"`
+	Unless string `yaml:"unless"`
+	// Headers are added to the requests made to the target. Values can
+	// reference env vars as $NAME or ${NAME}, which are expanded when the
+	// config is loaded.
+	Headers map[string]string `yaml:"headers"`
+	// DropLabels lists labels not to add to the metrics of the target,
+	// removing them from the labels it would otherwise get.
+	DropLabels []string `yaml:"drop_labels"`
+	// SeriesDropLabels lists regexes of names of labels stripped from the
+	// series of the target.
+	SeriesDropLabels []string `yaml:"series_drop_labels"`
+	// RelabelConfigs are applied, in order, to the labels and URL of the
+	// target when the config is loaded, possibly dropping the target.
+	RelabelConfigs []RelabelConfig `yaml:"relabel_configs"`
+	// LabelMap rewrites the values of labels of the series of the target,
+	// keyed by label name.
+	LabelMap map[string]LabelMapping `yaml:"label_map"`
+	// MetricRelabelConfigs are applied, in order, to the labels of each
+	// series of the target once scraped, its name included as __name__,
+	// possibly dropping the series.
+	MetricRelabelConfigs []RelabelConfig `yaml:"metric_relabel_configs"`
+	// Job, if set, is added to the metrics of the target as the job label.
+	Job string `yaml:"job"`
+	// HonorLabels keeps the labels the target already sets on its metrics
+	// when they clash with the labels added to them. By default, the
+	// target's labels are instead renamed to exported_<name>, as Prometheus
+	// does.
+	HonorLabels bool `yaml:"honor_labels"`
+	// LabelConflicts sets what to do, per label, when the metrics of the
+	// target already have a label added to them: override the target's
+	// value, keep it, prefix the target's label with exported_, or
+	// drop_metric to drop the clashing series. Labels not listed follow
+	// HonorLabels.
+	LabelConflicts map[string]string `yaml:"label_conflicts"`
+	// ScrapeProtocol overrides the exposition format requested from the
+	// target. One of text, openmetrics or protobuf. By default, protobuf is
+	// preferred with a fallback to text.
+	ScrapeProtocol string `yaml:"scrape_protocol"`
+	// MaxSeries, if positive, caps the number of series taken from the
+	// target after transformation. Series beyond the cap are dropped.
+	MaxSeries int `yaml:"max_series"`
+	// LabelLimit, LabelNameLengthLimit and LabelValueLengthLimit, if
+	// positive, limit the number of labels of each series of the target,
+	// added labels included, and the length of their names and values.
+	LabelLimit            int `yaml:"label_limit"`
+	LabelNameLengthLimit  int `yaml:"label_name_length_limit"`
+	LabelValueLengthLimit int `yaml:"label_value_length_limit"`
+	// LabelLimitAction is what to do when a series exceeds the label limits:
+	// drop_target (the default) leaves out all metrics of the target, the
+	// scrape counting as failed, while drop_series only leaves out the
+	// offending series.
+	LabelLimitAction string `yaml:"label_limit_action"`
+	// BodySizeLimit, if positive, overrides the body_size_limit of the
+	// config for the target.
+	BodySizeLimit int64 `yaml:"body_size_limit"`
+	// SampleLimit, if positive, is the number of samples above which the
+	// metrics of the target are left out altogether, the scrape counting as
+	// failed.
+	SampleLimit int `yaml:"sample_limit"`
+	// Timeout caps the time spent on each fetch from the target, including
+	// reading the response. It defaults to the scrape_timeout of the config.
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is the number of times a failed fetch is retried, waiting
+	// RetryBackoff before the first retry and doubling the wait after each.
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// RetryJitter randomizes each wait between zero and its computed
+	// duration, so that targets failing together don't retry in lockstep.
+	RetryJitter bool `yaml:"retry_jitter"`
+	// CacheTTL, if positive, is how long metrics fetched from the target
+	// are reused for, instead of fetching them again on every scrape.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// StaleMaxAge, if positive, serves the metrics last fetched from the
+	// target when fetching fails, as long as they are more recent than this.
+	// The target is still reported as down.
+	StaleMaxAge time.Duration `yaml:"stale_max_age"`
+	// BreakerThreshold, if positive, is the number of consecutive failed
+	// scrapes after which the target is skipped for BreakerCooldown, so
+	// that a dead target doesn't slow down every scrape.
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+	// Transforms lists the names of built-in transforms to apply, in order,
+	// to the metrics of the target. See transforms.go for the available ones.
+	Transforms []string `yaml:"transforms"`
+	// MetricRenames are applied, in order, to the names of the metric
+	// families of the target right after they are parsed.
+	MetricRenames []MetricRename `yaml:"metric_renames"`
+	// MetricAllow, if set, keeps only the metric families of the target
+	// whose name fully matches one of the regexes, while MetricDeny drops
+	// those whose name matches any. Names are matched after MetricRenames.
+	MetricAllow []string `yaml:"metric_allow"`
+	MetricDeny  []string `yaml:"metric_deny"`
+	// MetricPrefix, if set, is prepended to the names of all metric families
+	// of the target.
+	MetricPrefix string `yaml:"metric_prefix"`
+	// CollisionPrefix, if set, is prepended to the names of the metric
+	// families of the target that are also exposed by other targets, to
+	// keep them apart instead of merging them.
+	CollisionPrefix string `yaml:"collision_prefix"`
+	// Nested marks the target as another instance of this exporter, whose
+	// own pue_* metrics are renamed to pue_nested_* so they are kept apart
+	// from the ones of this instance.
+	Nested bool `yaml:"nested"`
+	// NonFiniteValues is what to do with counter, gauge and untyped samples
+	// whose value is NaN or infinite: keep (the default), drop, or replace
+	// with NonFiniteReplacement.
+	NonFiniteValues      string  `yaml:"non_finite_values"`
+	NonFiniteReplacement float64 `yaml:"non_finite_replacement"`
+	// TLSConfig configures TLS for HTTPS targets.
+	TLSConfig *TargetTLSConfig `yaml:"tls_config"`
+	// ProxyURL is the HTTP proxy the target is reached through. By default,
+	// the proxy is taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY env
+	// vars.
+	ProxyURL string `yaml:"proxy_url"`
+	// ProxyAuth, if set, authenticates with the proxy, separately from any
+	// authentication with the target itself.
+	ProxyAuth *ProxyAuth `yaml:"proxy_auth"`
+	// BasicAuth, if set, authenticates with the target using HTTP basic
+	// authentication.
+	BasicAuth *BasicAuth `yaml:"basic_auth"`
+	// BearerToken is a bearer token to authenticate with the target.
+	BearerToken string `yaml:"bearer_token"`
+	// BearerTokenFile is the path of a file holding a bearer token to
+	// authenticate with the target. It's read on every scrape, so that
+	// rotated tokens are picked up.
+	BearerTokenFile string `yaml:"bearer_token_file"`
+	// OAuth2, if set, authenticates with the target using an access token
+	// obtained through the OAuth2 client credentials flow.
+	OAuth2 *OAuth2 `yaml:"oauth2"`
+	// SigV4, if set, signs the requests made to the target with AWS
+	// Signature Version 4.
+	SigV4 *SigV4 `yaml:"sigv4"`
 
 	// labelsSerialized is the serialized form of Labels, used for directly
 	// injecting into upstream responses.
 	labelsSerialized string
+	// appliesTo is the applies_to regex of the labels scoped to some metric
+	// families, by label name.
+	appliesTo map[string]string
+	// labelScopes is the compiled form of appliesTo.
+	labelScopes map[string]*regexp.Regexp
+	// seriesDropLabels is the compiled form of SeriesDropLabels.
+	seriesDropLabels []*regexp.Regexp
+	// metricRelabel is the compiled form of MetricRelabelConfigs.
+	metricRelabel []relabelRule
+	// renames is the compiled form of MetricRenames.
+	renames []metricRename
+	// metricAllow and metricDeny are the compiled forms of MetricAllow and
+	// MetricDeny.
+	metricAllow, metricDeny []*regexp.Regexp
+	// auth, if set, authenticates the requests made to the target.
+	auth RequestAuthenticator
+	// client is used to fetch metrics from the target, or defaultClient if
+	// nil.
+	client *http.Client
+	// vault resolves references to Vault secrets in credentials, if Vault
+	// is configured.
+	vault *vaultClient
+	// group is the name of the group the target belongs to, if any.
+	group string
+	// unknownFields lists where the target was given fields in the config
+	// it doesn't have, e.g. misspelled ones, for --check-config to reject.
+	unknownFields []string
 }
 
 // Config is the configuration for the exporter.
 type Config struct {
-	Listen  string   `yaml:"listen"`
-	Targets []Target `yaml:"targets"`
+	Listen  string         `yaml:"listen"`
+	Targets []Target       `yaml:"targets"`
+	HTTPSD  []HTTPSDConfig `yaml:"http_sd"`
+	FileSD  []FileSDConfig `yaml:"file_sd"`
+	DNSSD   []DNSSDConfig  `yaml:"dns_sd"`
+	// KubernetesSD discovers targets from the Kubernetes API.
+	KubernetesSD []KubernetesSDConfig `yaml:"kubernetes_sd"`
+	// ConsulSD discovers targets from services registered in Consul.
+	ConsulSD []ConsulSDConfig `yaml:"consul_sd"`
+	// DockerSD discovers targets from labeled containers of a Docker daemon.
+	DockerSD []DockerSDConfig `yaml:"docker_sd"`
+	// Labels are added to the labels of every target, static or
+	// discovered, unless the target sets them itself.
+	Labels map[string]string `yaml:"labels"`
+	// SeriesDropLabels lists regexes of names of labels stripped from all
+	// series of all targets, e.g. to leave out ephemeral labels.
+	SeriesDropLabels []string `yaml:"series_drop_labels"`
+	// LabelMap rewrites the values of labels of the series of all targets,
+	// keyed by label name, after the label_map of each target.
+	LabelMap map[string]LabelMapping `yaml:"label_map"`
+	// InstanceLabel adds the host:port of each target to its metrics as the
+	// instance label, as Prometheus would when scraping it directly.
+	InstanceLabel bool `yaml:"instance_label"`
+	// Groups are named groups of targets, served on their own at
+	// /metrics/<name> in addition to along with all other targets.
+	Groups []Group `yaml:"groups"`
+	// Include lists glob patterns of files with more targets, under the
+	// targets key, e.g. targets.d/*.yaml for one file per team. Relative
+	// patterns are relative to the directory of the config file.
+	Include []string `yaml:"include"`
+	// MergeLabels, if set, restricts the labels identifying series when
+	// merging the metrics of all targets to the listed ones. Series of a
+	// metric family with the same values for those labels are summed into
+	// one, stripped of all other labels.
+	MergeLabels []string `yaml:"merge_labels"`
+	// MaxConcurrentFetches, if positive, caps the number of targets scraped
+	// at once for each request, the others waiting for their turn.
+	MaxConcurrentFetches int `yaml:"max_concurrent_fetches"`
+	// FetchMemoryBudget, if positive, is the number of bytes of target
+	// responses read and parsed at once, above which reading responses
+	// waits for others to be done.
+	FetchMemoryBudget int64 `yaml:"fetch_memory_budget"`
+	// ScrapeInterval, if positive, scrapes targets in the background at this
+	// interval, and serves the metrics of the latest scrape to all requests
+	// instead of scraping targets for each of them.
+	ScrapeInterval time.Duration `yaml:"scrape_interval"`
+	// ScrapeTimeout is the timeout of fetches from targets not setting their
+	// own.
+	ScrapeTimeout time.Duration `yaml:"scrape_timeout"`
+	// ScrapeDeadline, if positive, caps the time spent scraping targets for
+	// each request. Metrics of targets not scraped by then are left out,
+	// and the targets reported as down.
+	ScrapeDeadline time.Duration `yaml:"scrape_deadline"`
+	// EmptyResponseStatus is the HTTP status of responses to scrapes in
+	// which no target yielded any metrics, e.g. because all are down or all
+	// their metrics were filtered out. It defaults to 200, while 503 makes
+	// such scrapes count as failed.
+	EmptyResponseStatus int `yaml:"empty_response_status"`
+	// ValidateOutput checks the collated metrics before serving them, e.g.
+	// for duplicate series or inconsistent types resulting from merging,
+	// and fails the scrape with a 500 instead of serving invalid output.
+	// This comes at an extra cost for every scrape.
+	ValidateOutput bool `yaml:"validate_output"`
+	// Gzip compresses responses to /metrics for clients accepting it, at
+	// GzipLevel, from 1 (fastest) to 9 (smallest), or the default level of
+	// compress/gzip if not set.
+	Gzip      bool `yaml:"gzip"`
+	GzipLevel int  `yaml:"gzip_level"`
+	// BodySizeLimit is the size in bytes above which the bodies of target
+	// responses, once decompressed, are rejected, unless a target sets its
+	// own. It defaults to 100 MiB.
+	BodySizeLimit int64 `yaml:"body_size_limit"`
+	// ReadBufferSize is the size in bytes of the buffer used when reading
+	// and parsing the bodies of target responses.
+	ReadBufferSize int `yaml:"read_buffer_size"`
+	// TimestampSamples sets the timestamp of every served sample to the time
+	// of the scrape. Any timestamps exposed by targets are overridden, so
+	// this can't be combined with preserving upstream timestamps.
+	TimestampSamples bool `yaml:"timestamp_samples"`
+	// ReadyMinTargets is the number of targets that must be reachable for
+	// /-/ready?check=targets to report ready, probing them for at most
+	// ReadyProbeTimeout.
+	ReadyMinTargets   int           `yaml:"ready_min_targets"`
+	ReadyProbeTimeout time.Duration `yaml:"ready_probe_timeout"`
+	// TraceTimeouts logs how long each phase (DNS, connect, TLS handshake,
+	// first byte and body) took when fetching from a target times out or
+	// misses the scrape deadline.
+	TraceTimeouts bool `yaml:"trace_timeouts"`
+	// TelemetryPath, if set, is the path the exporter's own metrics are
+	// served on, along with Go runtime and process metrics, instead of being
+	// served along with the metrics of targets.
+	TelemetryPath string `yaml:"telemetry_path"`
+	// ReloadEndpoint enables POST /-/reload, reloading the config as on
+	// SIGHUP.
+	ReloadEndpoint bool `yaml:"reload_endpoint"`
+	// PprofListen, if set, is the address of a separate listener serving
+	// the net/http/pprof profiling endpoints under /debug/pprof/.
+	PprofListen string `yaml:"pprof_listen"`
+	// DebugEndpoints enables the endpoints under /debug/ meant for
+	// troubleshooting the exporter.
+	DebugEndpoints bool `yaml:"debug_endpoints"`
+	// DebugOutputLimit caps the size in bytes of the responses of the debug
+	// endpoints, past which they are truncated.
+	DebugOutputLimit int64 `yaml:"debug_output_limit"`
+	// Graphite, if set, serves the metrics in the Graphite plaintext format
+	// in addition to the Prometheus one.
+	Graphite *GraphiteConfig `yaml:"graphite"`
+	// TLS, if set, serves metrics over HTTPS.
+	TLS *TLSConfig `yaml:"tls"`
+	// Vault, if set, allows credentials of targets to reference secrets
+	// in HashiCorp Vault.
+	Vault *VaultConfig `yaml:"vault"`
+	// Auth, if set, requires clients to authenticate.
+	Auth *ServerAuth `yaml:"auth"`
+	// ListenAllowCIDRs, if set, restricts the clients of the exporter to
+	// the listed networks, rejecting others with a 403.
+	ListenAllowCIDRs []string `yaml:"listen_allow_cidrs"`
+
+	// seriesDropLabels is the compiled form of SeriesDropLabels.
+	seriesDropLabels []*regexp.Regexp
+	// vault fetches secrets from Vault if configured.
+	vault *vaultClient
+	// allowedPrefixes is the parsed form of ListenAllowCIDRs.
+	allowedPrefixes []netip.Prefix
+	// fetchBudget enforces FetchMemoryBudget if set.
+	fetchBudget *memoryBudget
+	// discoverers are the service discovery mechanisms providing targets in
+	// addition to the statically configured ones, started once the config
+	// is applied.
+	discoverers []discoverer
 }
 
-var cfg *Config
+// defaultListen is the address listened on when none is configured. It can
+// be changed at build time with -ldflags "-X main.defaultListen=<addr>" or at
+// runtime with the PUE_DEFAULT_LISTEN env var.
+var defaultListen = "0.0.0.0:9001"
+
+// listenOverride, if set with the --listen flag, is listened on instead of
+// the configured listen address.
+var listenOverride string
 
 // loadConfig loads the configuration from the given path.
 func loadConfig(path string) (*Config, error) {
-	f, err := os.Open(path)
+	f, err := readConfigFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	var doc yaml.Node
+	if err := yaml.NewDecoder(f).Decode(&doc); err != nil {
+		return nil, err
+	}
 	var cfg Config
-	if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
+	if err := doc.Decode(&cfg); err != nil {
 		return nil, err
 	}
+	if listenOverride != "" {
+		cfg.Listen = listenOverride
+	}
 	if cfg.Listen == "" {
-		cfg.Listen = "0.0.0.0:9001"
+		// An explicitly empty listen address is more likely a templating
+		// mistake than a request for the default.
+		if hasKey(&doc, "listen") {
+			return nil, fmt.Errorf("listen must not be empty")
+		}
+		cfg.Listen = defaultListen
+		if l := os.Getenv("PUE_DEFAULT_LISTEN"); l != "" {
+			cfg.Listen = l
+		}
+	}
+	switch {
+	case cfg.EmptyResponseStatus == 0:
+		cfg.EmptyResponseStatus = http.StatusOK
+	case cfg.EmptyResponseStatus < 200 || cfg.EmptyResponseStatus > 599:
+		return nil, fmt.Errorf("invalid empty_response_status %d", cfg.EmptyResponseStatus)
+	}
+	if cfg.ScrapeTimeout <= 0 {
+		cfg.ScrapeTimeout = 10 * time.Second
+	}
+	switch {
+	case cfg.GzipLevel == 0:
+		cfg.GzipLevel = gzip.DefaultCompression
+	case cfg.GzipLevel < gzip.BestSpeed || cfg.GzipLevel > gzip.BestCompression:
+		return nil, fmt.Errorf("invalid gzip_level %d", cfg.GzipLevel)
+	}
+	if cfg.ReadyMinTargets <= 0 {
+		cfg.ReadyMinTargets = 1
 	}
-	// Serialize labels into k="v" pairs separated by ,.
+	if cfg.ReadyProbeTimeout <= 0 {
+		cfg.ReadyProbeTimeout = 5 * time.Second
+	}
+	if cfg.DebugOutputLimit <= 0 {
+		cfg.DebugOutputLimit = 10 << 20
+	}
+	if cfg.BodySizeLimit <= 0 {
+		cfg.BodySizeLimit = 100 << 20
+	}
+	if cfg.ReadBufferSize <= 0 {
+		cfg.ReadBufferSize = 32 * 1024
+	}
+	if cfg.FetchMemoryBudget > 0 {
+		cfg.fetchBudget = newMemoryBudget(cfg.FetchMemoryBudget)
+	}
+	if cfg.seriesDropLabels, err = compileAnchored(cfg.SeriesDropLabels); err != nil {
+		return nil, fmt.Errorf("series_drop_labels: %w", err)
+	}
+	if err := validateLabelMap(cfg.LabelMap); err != nil {
+		return nil, fmt.Errorf("label_map: %w", err)
+	}
+	files, err := includedFiles(path, cfg.Include)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		inc, err := loadInclude(file, false)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %w", file, err)
+		}
+		cfg.Targets = append(cfg.Targets, inc.Targets...)
+	}
+	grouped, err := expandGroups(cfg.Groups)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Targets = append(cfg.Targets, grouped...)
+	// Leave out targets whose conditions don't hold.
+	targets := cfg.Targets[:0]
+	for _, t := range cfg.Targets {
+		if (t.If == "" || evalCondition(t.If)) && (t.Unless == "" || !evalCondition(t.Unless)) {
+			targets = append(targets, t)
+		}
+	}
+	cfg.Targets = targets
+	// Add the global labels, then relabel, leaving out dropped targets.
+	targets = cfg.Targets[:0]
 	for i, t := range cfg.Targets {
-		var l []string
-		for k, v := range t.Labels {
-			l = append(l, fmt.Sprintf(`%s="%s"`, k, v))
+		t.Labels = cfg.targetLabels(t)
+		if len(t.RelabelConfigs) > 0 {
+			keep, err := relabelTarget(&t)
+			if err != nil {
+				return nil, fmt.Errorf("target #%d: relabel_configs: %w", i+1, err)
+			}
+			if !keep {
+				continue
+			}
+		}
+		targets = append(targets, t)
+	}
+	cfg.Targets = targets
+	if cfg.Vault != nil {
+		v, err := newVaultClient(*cfg.Vault)
+		if err != nil {
+			return nil, fmt.Errorf("vault: %w", err)
+		}
+		cfg.vault = v
+	}
+	// Validate the targets, serialize their labels and set their defaults.
+	seen := map[string]bool{}
+	for i, t := range cfg.Targets {
+		t.vault = cfg.vault
+		cfg.Targets[i].vault = cfg.vault
+		if err := validateTargetURL(t.URL); err != nil {
+			return nil, fmt.Errorf("target #%d: %w", i+1, err)
+		}
+		for name := range t.Labels {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("target %s: invalid label name %q", t.URL, name)
+			}
+		}
+		for _, name := range t.DropLabels {
+			delete(t.Labels, name)
+		}
+		if cfg.Targets[i].seriesDropLabels, err = compileAnchored(t.SeriesDropLabels); err != nil {
+			return nil, fmt.Errorf("target %s: series_drop_labels: %w", t.URL, err)
+		}
+		cfg.Targets[i].labelsSerialized = serializeLabels(t.Labels)
+		key := t.URL + "{" + cfg.Targets[i].labelsSerialized + "}"
+		if seen[key] {
+			return nil, fmt.Errorf("target %s: duplicate of another target with the same labels", t.URL)
+		}
+		seen[key] = true
+		setTargetDefaults(&cfg.Targets[i])
+		if _, ok := scrapeProtocolAccept[t.ScrapeProtocol]; !ok {
+			return nil, fmt.Errorf("target %s: unknown scrape_protocol %q", t.URL, t.ScrapeProtocol)
+		}
+		for name, re := range t.appliesTo {
+			r, err := regexp.Compile("^(?:" + re + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("target %s: label %s: applies_to: %w", t.URL, name, err)
+			}
+			if cfg.Targets[i].labelScopes == nil {
+				cfg.Targets[i].labelScopes = map[string]*regexp.Regexp{}
+			}
+			cfg.Targets[i].labelScopes[name] = r
+		}
+		cfg.Targets[i].renames = nil
+		for _, rename := range t.MetricRenames {
+			r, err := regexp.Compile("^(?:" + rename.Match + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("target %s: metric_renames: %w", t.URL, err)
+			}
+			cfg.Targets[i].renames = append(cfg.Targets[i].renames, metricRename{r, rename.Replacement})
+		}
+		if err := validateLabelMap(t.LabelMap); err != nil {
+			return nil, fmt.Errorf("target %s: label_map: %w", t.URL, err)
+		}
+		if cfg.Targets[i].metricRelabel, err = compileRelabelConfigs(t.MetricRelabelConfigs); err != nil {
+			return nil, fmt.Errorf("target %s: metric_relabel_configs: %w", t.URL, err)
+		}
+		if cfg.Targets[i].metricAllow, err = compileAnchored(t.MetricAllow); err != nil {
+			return nil, fmt.Errorf("target %s: metric_allow: %w", t.URL, err)
+		}
+		if cfg.Targets[i].metricDeny, err = compileAnchored(t.MetricDeny); err != nil {
+			return nil, fmt.Errorf("target %s: metric_deny: %w", t.URL, err)
+		}
+		for _, name := range t.Transforms {
+			if _, ok := transforms[name]; !ok {
+				return nil, fmt.Errorf("target %s: unknown transform %q", t.URL, name)
+			}
+		}
+		if t.MetricPrefix != "" && !model.IsValidMetricName(model.LabelValue(t.MetricPrefix+"x")) {
+			return nil, fmt.Errorf("target %s: invalid metric_prefix %q", t.URL, t.MetricPrefix)
+		}
+		switch t.LabelLimitAction {
+		case "", "drop_target", "drop_series":
+		default:
+			return nil, fmt.Errorf("target %s: unknown label_limit_action %q", t.URL, t.LabelLimitAction)
+		}
+		for name, policy := range t.LabelConflicts {
+			switch policy {
+			case "override", "keep", "prefix", "drop_metric":
+			default:
+				return nil, fmt.Errorf("target %s: unknown label_conflicts policy %q for %s", t.URL, policy, name)
+			}
+		}
+		switch t.NonFiniteValues {
+		case "", "keep", "drop", "replace":
+		default:
+			return nil, fmt.Errorf("target %s: unknown non_finite_values %q", t.URL, t.NonFiniteValues)
+		}
+		for name, value := range t.Headers {
+			v, err := expandHeader(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("target %s: %w", t.URL, err)
+			}
+			t.Headers[name] = v
+		}
+		client, err := newTargetClient(t)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", t.URL, err)
+		}
+		cfg.Targets[i].client = client
+		timeout := t.Timeout
+		if timeout <= 0 {
+			timeout = cfg.ScrapeTimeout
+		}
+		auth, err := newAuthenticator(cfg.Targets[i], timeout)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", t.URL, err)
+		}
+		cfg.Targets[i].auth = auth
+	}
+	if p := cfg.TelemetryPath; p != "" && (!strings.HasPrefix(p, "/") || p == "/metrics" || strings.HasPrefix(p, "/metrics/")) {
+		return nil, fmt.Errorf("invalid telemetry_path %q", p)
+	}
+	if g := cfg.Graphite; g != nil {
+		if g.Path == "" {
+			g.Path = "/graphite"
+		}
+		switch g.Naming {
+		case "":
+			g.Naming = "dotted"
+		case "dotted", "tagged":
+		default:
+			return nil, fmt.Errorf("graphite: unknown naming %q", g.Naming)
+		}
+	}
+	for _, cidr := range cfg.ListenAllowCIDRs {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("listen_allow_cidrs: %w", err)
+		}
+		cfg.allowedPrefixes = append(cfg.allowedPrefixes, p.Masked())
+	}
+	if cfg.Auth != nil && cfg.Auth.Basic != nil {
+		if err := cfg.Auth.Basic.validate(); err != nil {
+			return nil, fmt.Errorf("auth.basic: %w", err)
+		}
+	}
+	if cfg.TLS != nil && (cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("tls: cert_file and key_file must both be set")
+	}
+	for i, sd := range cfg.HTTPSD {
+		if sd.URL == "" {
+			return nil, fmt.Errorf("http_sd #%d: url must be set", i+1)
+		}
+		c := &cfg.HTTPSD[i]
+		setSDDefaults(&c.RefreshInterval, &c.Scheme, &c.MetricsPath, time.Minute)
+	}
+	for i, sd := range cfg.FileSD {
+		if len(sd.Files) == 0 {
+			return nil, fmt.Errorf("file_sd #%d: files must be set", i+1)
+		}
+		// Like includes, relative patterns are relative to the directory of
+		// the config file, resolved here so that the config compares equal
+		// on reload no matter the working directory.
+		files := make([]string, len(sd.Files))
+		for j, pattern := range sd.Files {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("file_sd #%d: invalid pattern %q: %w", i+1, pattern, err)
+			}
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			files[j] = pattern
+		}
+		cfg.FileSD[i].Files = files
+		c := &cfg.FileSD[i]
+		setSDDefaults(&c.RefreshInterval, &c.Scheme, &c.MetricsPath, 30*time.Second)
+	}
+	for i, sd := range cfg.DNSSD {
+		if len(sd.Names) == 0 {
+			return nil, fmt.Errorf("dns_sd #%d: names must be set", i+1)
+		}
+		switch sd.Type {
+		case "":
+			cfg.DNSSD[i].Type = "SRV"
+		case "SRV":
+		case "A", "AAAA":
+			if sd.Port <= 0 || sd.Port > 65535 {
+				return nil, fmt.Errorf("dns_sd #%d: port must be set for %s records", i+1, sd.Type)
+			}
+		default:
+			return nil, fmt.Errorf("dns_sd #%d: invalid type %q, must be SRV, A or AAAA", i+1, sd.Type)
+		}
+		c := &cfg.DNSSD[i]
+		setSDDefaults(&c.RefreshInterval, &c.Scheme, &c.MetricsPath, 30*time.Second)
+	}
+	for i, sd := range cfg.KubernetesSD {
+		switch sd.Role {
+		case "":
+			cfg.KubernetesSD[i].Role = "pod"
+		case "pod", "service", "endpoints":
+		default:
+			return nil, fmt.Errorf("kubernetes_sd #%d: invalid role %q, must be pod, service or endpoints", i+1, sd.Role)
+		}
+		if sd.APIServer == "" {
+			server, ok := inClusterAPIServer()
+			if !ok {
+				return nil, fmt.Errorf("kubernetes_sd #%d: api_server must be set when not running in a cluster", i+1)
+			}
+			cfg.KubernetesSD[i].APIServer = server
+			if sd.BearerTokenFile == "" {
+				cfg.KubernetesSD[i].BearerTokenFile = serviceAccountDir + "token"
+			}
+			if sd.CAFile == "" {
+				cfg.KubernetesSD[i].CAFile = serviceAccountDir + "ca.crt"
+			}
+		}
+		c := &cfg.KubernetesSD[i]
+		setSDDefaults(&c.RefreshInterval, &c.Scheme, &c.MetricsPath, 30*time.Second)
+	}
+	for i, sd := range cfg.ConsulSD {
+		if len(sd.Services) == 0 {
+			return nil, fmt.Errorf("consul_sd #%d: services must be set", i+1)
+		}
+		if sd.Server == "" {
+			cfg.ConsulSD[i].Server = os.Getenv("CONSUL_HTTP_ADDR")
+			if cfg.ConsulSD[i].Server == "" {
+				cfg.ConsulSD[i].Server = "http://127.0.0.1:8500"
+			}
+		}
+		// CONSUL_HTTP_ADDR is commonly set without a scheme.
+		if !strings.Contains(cfg.ConsulSD[i].Server, "://") {
+			cfg.ConsulSD[i].Server = "http://" + cfg.ConsulSD[i].Server
+		}
+		if sd.Token == "" {
+			cfg.ConsulSD[i].Token = os.Getenv("CONSUL_HTTP_TOKEN")
+		}
+		c := &cfg.ConsulSD[i]
+		setSDDefaults(&c.RefreshInterval, &c.Scheme, &c.MetricsPath, 30*time.Second)
+	}
+	for i, sd := range cfg.DockerSD {
+		if sd.Host == "" {
+			cfg.DockerSD[i].Host = os.Getenv("DOCKER_HOST")
+			if cfg.DockerSD[i].Host == "" {
+				cfg.DockerSD[i].Host = "unix:///var/run/docker.sock"
+			}
+		}
+		if h := cfg.DockerSD[i].Host; !strings.HasPrefix(h, "unix://") && !strings.HasPrefix(h, "tcp://") {
+			return nil, fmt.Errorf("docker_sd #%d: host must be a unix:// or tcp:// address", i+1)
 		}
-		cfg.Targets[i].labelsSerialized = strings.Join(l, ",")
+		c := &cfg.DockerSD[i]
+		setSDDefaults(&c.RefreshInterval, &c.Scheme, &c.MetricsPath, 30*time.Second)
 	}
 
 	return &cfg, nil
 }
 
-func fetchMetrics(url string) (map[string]*dto.MetricFamily, error) {
-	resp, err := http.Get(url)
+// evalCondition evaluates a condition on env vars of the form NAME, true
+// when the env var is non-empty, or NAME=VALUE, true when the env var is
+// set to VALUE.
+func evalCondition(cond string) bool {
+	if name, value, ok := strings.Cut(cond, "="); ok {
+		v, set := os.LookupEnv(name)
+		return set && v == value
+	}
+	return os.Getenv(cond) != ""
+}
+
+// hasKey reports whether the YAML document has the given top level key.
+func hasKey(doc *yaml.Node, key string) bool {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return false
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptHeader is sent to targets when fetching metrics. The protobuf format
+// is preferred as it is the only one able to carry native histograms.
+const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3,*/*;q=0.1`
+
+// scrapeProtocolAccept maps each scrape protocol to the Accept header sent to
+// targets using it. Like Prometheus, targets asked for OpenMetrics may fall
+// back to text.
+var scrapeProtocolAccept = map[string]string{
+	"":            acceptHeader,
+	"text":        `text/plain;version=0.0.4`,
+	"openmetrics": `application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1`,
+	"protobuf":    `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited`,
+}
+
+// validateTargetURL returns an error unless rawURL is an absolute http or
+// https URL.
+func validateTargetURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("url %q must be an absolute http or https URL", rawURL)
+	}
+	return nil
+}
+
+// serializeLabels returns labels as k="v" pairs separated by , in the order
+// of their names, so that targets with the same labels serialize the same.
+func serializeLabels(labels map[string]string) string {
+	var l []string
+	for k, v := range labels {
+		l = append(l, fmt.Sprintf(`%s="%s"`, k, v))
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+// setTargetDefaults sets the fields of t which have defaults to them if
+// unset.
+func setTargetDefaults(t *Target) {
+	if t.RetryBackoff <= 0 {
+		t.RetryBackoff = 100 * time.Millisecond
+	}
+	if t.BreakerCooldown <= 0 {
+		t.BreakerCooldown = time.Minute
+	}
+}
+
+// fetchMetrics fetches the metrics of target t, retrying on failure as
+// configured for the target, until ctx is done or its deadline is too close
+// for another attempt.
+func fetchMetrics(ctx context.Context, t Target) (map[string]*dto.MetricFamily, error) {
+	backoff := t.RetryBackoff
+	for retry := 0; ; retry++ {
+		metricFamilies, err := fetchMetricsOnce(ctx, t)
+		if err != nil {
+			targetFetchErrorsTotal.WithLabelValues(t.URL).Inc()
+		}
+		if err == nil || retry >= t.Retries {
+			return metricFamilies, err
+		}
+		wait := backoff
+		if t.RetryJitter {
+			wait = time.Duration(rand.Int63n(int64(backoff) + 1))
+		}
+		// Don't bother waiting if the retry would miss the deadline anyway.
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return nil, err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func fetchMetricsOnce(ctx context.Context, t Target) (_ map[string]*dto.MetricFamily, err error) {
+	cfg := currentConfig()
+	timeout := t.Timeout
+	if timeout <= 0 {
+		timeout = cfg.ScrapeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TraceTimeouts {
+		trace := newPhaseTrace()
+		req = req.WithContext(trace.withContext(req.Context()))
+		defer func() {
+			took := time.Since(trace.start)
+			if isTimeout(err) || cfg.ScrapeDeadline > 0 && took > cfg.ScrapeDeadline {
+				warnf("fetching metrics from %s timed out after %s: %s", t.URL, took, trace.breakdown(time.Now()))
+			}
+		}()
+	}
+	req.Header.Set("Accept", scrapeProtocolAccept[t.ScrapeProtocol])
+	// Setting Accept-Encoding disables the transparent gzip decoding of the
+	// transport, which is done by decodeContent instead along with deflate.
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	if err := t.prepareRequest(req); err != nil {
+		return nil, err
+	}
+	resp, err := t.httpClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		expiry := resp.TLS.PeerCertificates[0].NotAfter
+		targetCertExpiry.WithLabelValues(t.URL).Set(float64(expiry.Unix()))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	content, err := decodeContent(resp)
 	if err != nil {
 		return nil, err
 	}
+	limit := t.BodySizeLimit
+	if limit <= 0 {
+		limit = cfg.BodySizeLimit
+	}
+	limited := &limitedReader{r: content, n: limit}
+	var r io.Reader = limited
+	if cfg.fetchBudget != nil {
+		br := cfg.fetchBudget.reader(ctx, limited)
+		defer br.Close()
+		r = br
+	}
+	body := bufio.NewReaderSize(&countingReader{
+		r: r,
+		c: scrapeBytesTotal.WithLabelValues(t.URL),
+	}, cfg.ReadBufferSize)
+	metricFamilies, err := decodeMetrics(body, responseFormat(resp.Header))
+	if limited.exceeded {
+		return nil, fmt.Errorf("response body exceeds body_size_limit of %d bytes", limit)
+	}
+	if err != nil {
+		targetParseErrorsTotal.WithLabelValues(t.URL).Inc()
+	}
+	return metricFamilies, err
+}
 
-	var parser expfmt.TextParser
-	return parser.TextToMetricFamilies(strings.NewReader(string(body)))
+// decodeMetrics decodes metric families from r in the given format. Anything
+// other than delimited protobuf and OpenMetrics is parsed as text.
+func decodeMetrics(r io.Reader, format expfmt.Format) (map[string]*dto.MetricFamily, error) {
+	if format == expfmt.FmtOpenMetrics {
+		r = newOpenMetricsReader(r)
+	}
+	if format != expfmt.FmtProtoDelim {
+		var parser expfmt.TextParser
+		return parser.TextToMetricFamilies(r)
+	}
+	metricFamilies := map[string]*dto.MetricFamily{}
+	decoder := expfmt.NewDecoder(r, format)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := decoder.Decode(mf); err == io.EOF {
+			return metricFamilies, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if emf, ok := metricFamilies[mf.GetName()]; ok {
+			emf.Metric = append(emf.Metric, mf.Metric...)
+		} else {
+			metricFamilies[mf.GetName()] = mf
+		}
+	}
 }
 
-func addLabels(metrics map[string]*dto.MetricFamily, labels map[string]string) {
-	for _, mf := range metrics {
+// transformMetrics applies the transformations configured for target t to its
+// metric families and returns the result. Metrics are modified in place.
+func transformMetrics(t Target, metricFamilies map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	if t.Nested {
+		renameNestedSelfMetrics(metricFamilies)
+	}
+	if len(t.renames) > 0 {
+		renameMetrics(metricFamilies, t.renames)
+	}
+	if len(t.metricAllow) > 0 || len(t.metricDeny) > 0 {
+		filterMetrics(metricFamilies, t.metricAllow, t.metricDeny)
+	}
+	for _, name := range t.Transforms {
+		transforms[name](metricFamilies)
+	}
+	if t.NonFiniteValues == "drop" || t.NonFiniteValues == "replace" {
+		handleNonFinite(metricFamilies, t.NonFiniteValues, t.NonFiniteReplacement)
+	}
+	if t.MetricPrefix != "" {
+		prefixMetricNames(metricFamilies, t.MetricPrefix)
+	}
+	addLabels(metricFamilies, t.Labels, t.labelScopes, t.conflictPolicy)
+	if len(t.metricRelabel) > 0 {
+		if n := relabelMetrics(metricFamilies, t.metricRelabel); n > 0 {
+			warnf("dropped %d series from %s renamed by metric_relabel_configs into a family of a different type", n, t.URL)
+			relabelTypeMismatchesTotal.WithLabelValues(t.URL).Add(float64(n))
+		}
+	}
+	if len(t.seriesDropLabels) > 0 {
+		dropMatchingLabels(metricFamilies, t.seriesDropLabels)
+	}
+	if len(t.LabelMap) > 0 {
+		mapLabelValues(metricFamilies, t.LabelMap)
+	}
+	return metricFamilies
+}
+
+// processMetrics transforms the metrics fetched from target t and enforces
+// its limits, returning what is left of them along with an error if they were
+// dropped for exceeding a limit. The limits hit are logged and kept track of
+// in the exporter's own metrics.
+func processMetrics(t Target, metricFamilies map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error) {
+	metricFamilies, hit, err := limitMetrics(t, metricFamilies)
+	if hit.labelLimits != nil {
+		if t.LabelLimitAction == "drop_series" {
+			warnf("dropped series from %s exceeding label limits, e.g. %v", t.URL, hit.labelLimits)
+		} else {
+			warnf("dropping metrics from %s: %v", t.URL, hit.labelLimits)
+		}
+	}
+	if t.SampleLimit > 0 {
+		if hit.samples > 0 {
+			warnf("dropping metrics from %s: %d samples exceed sample_limit of %d", t.URL, hit.samples, t.SampleLimit)
+		}
+		setGauge(targetExceededSampleLimit.WithLabelValues(t.URL), hit.samples > 0)
+	}
+	if t.MaxSeries > 0 {
+		if hit.truncated {
+			warnf("truncated metrics from %s to %d series", t.URL, t.MaxSeries)
+		}
+		setGauge(targetSeriesTruncated.WithLabelValues(t.URL), hit.truncated)
+	}
+	return metricFamilies, err
+}
+
+// limitsHit tells which limits the metrics of a target ran into.
+type limitsHit struct {
+	// labelLimits is the first violation of the label limits, if any.
+	labelLimits error
+	// samples is the number of samples if over the sample limit, else 0.
+	samples int
+	// truncated is whether series were dropped beyond max_series.
+	truncated bool
+}
+
+// limitMetrics is like processMetrics but leaves it to the caller to report
+// the limits hit, so that the metrics of a target can be previewed without
+// it counting as a scrape.
+func limitMetrics(t Target, metricFamilies map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, limitsHit, error) {
+	metricFamilies = transformMetrics(t, metricFamilies)
+	var hit limitsHit
+	var err error
+	if t.LabelLimit > 0 || t.LabelNameLengthLimit > 0 || t.LabelValueLengthLimit > 0 {
+		if lerr := enforceLabelLimits(t, metricFamilies); lerr != nil {
+			hit.labelLimits = lerr
+			if t.LabelLimitAction != "drop_series" {
+				metricFamilies = nil
+				err = lerr
+			}
+		}
+	}
+	if t.SampleLimit > 0 {
+		if n := countSamples(metricFamilies); n > t.SampleLimit {
+			hit.samples = n
+			metricFamilies = nil
+			err = fmt.Errorf("sample limit exceeded: %d > %d", n, t.SampleLimit)
+		}
+	}
+	if t.MaxSeries > 0 {
+		hit.truncated = truncateSeries(metricFamilies, t.MaxSeries)
+	}
+	return metricFamilies, hit, err
+}
+
+// truncateSeries drops series from the metric families beyond the first limit,
+// in order of family name, and reports whether any were dropped.
+func truncateSeries(metricFamilies map[string]*dto.MetricFamily, limit int) bool {
+	names := make([]string, 0, len(metricFamilies))
+	for n := range metricFamilies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	truncated := false
+	for _, n := range names {
+		mf := metricFamilies[n]
+		if len(mf.Metric) > limit {
+			mf.Metric = mf.Metric[:limit]
+			truncated = true
+		}
+		limit -= len(mf.Metric)
+		if len(mf.Metric) == 0 {
+			delete(metricFamilies, n)
+		}
+	}
+	return truncated
+}
+
+// scopedLabel is a label of a target scoped to some metric families.
+type scopedLabel struct {
+	Value     string `yaml:"value"`
+	AppliesTo string `yaml:"applies_to"`
+}
+
+// UnmarshalYAML decodes a target, taking the applies_to of its scoped labels
+// out of its labels.
+func (t *Target) UnmarshalYAML(node *yaml.Node) error {
+	type plain Target
+	var appliesTo map[string]string
+	var unknown []string
+	if node.Kind == yaml.MappingNode {
+		// The node is copied rather than modified, as it may be decoded
+		// again.
+		node = copyNode(node)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value != "labels" || node.Content[i+1].Kind != yaml.MappingNode {
+				continue
+			}
+			labels := copyNode(node.Content[i+1])
+			node.Content[i+1] = labels
+			for j := 0; j+1 < len(labels.Content); j += 2 {
+				if labels.Content[j+1].Kind != yaml.MappingNode {
+					continue
+				}
+				var l scopedLabel
+				if err := labels.Content[j+1].Decode(&l); err != nil {
+					return err
+				}
+				if appliesTo == nil {
+					appliesTo = map[string]string{}
+				}
+				appliesTo[labels.Content[j].Value] = l.AppliesTo
+				unknown = append(unknown, unknownFields(labels.Content[j+1], reflect.TypeOf(l))...)
+				labels.Content[j+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: l.Value}
+			}
+		}
+	}
+	if err := node.Decode((*plain)(t)); err != nil {
+		return err
+	}
+	t.appliesTo = appliesTo
+	t.unknownFields = append(unknown, unknownFields(node, reflect.TypeOf(plain{}))...)
+	return nil
+}
+
+// MarshalYAML encodes a target, putting the applies_to of its scoped labels
+// back into its labels, so that they count towards the config hash.
+func (t Target) MarshalYAML() (interface{}, error) {
+	type plain Target
+	var node yaml.Node
+	if err := node.Encode(plain(t)); err != nil {
+		return nil, err
+	}
+	if len(t.appliesTo) == 0 {
+		return &node, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != "labels" {
+			continue
+		}
+		labels := node.Content[i+1]
+		for j := 0; j+1 < len(labels.Content); j += 2 {
+			re, ok := t.appliesTo[labels.Content[j].Value]
+			if !ok {
+				continue
+			}
+			var scoped yaml.Node
+			if err := scoped.Encode(scopedLabel{Value: labels.Content[j+1].Value, AppliesTo: re}); err != nil {
+				return nil, err
+			}
+			labels.Content[j+1] = &scoped
+		}
+	}
+	return &node, nil
+}
+
+// copyNode returns a shallow copy of node with its own content.
+func copyNode(node *yaml.Node) *yaml.Node {
+	c := *node
+	c.Content = append([]*yaml.Node(nil), node.Content...)
+	return &c
+}
+
+// conflictPolicy returns what to do when the metrics of the target already
+// have label name, which is one of the label_conflicts policies.
+func (t Target) conflictPolicy(name string) string {
+	if policy, ok := t.LabelConflicts[name]; ok {
+		return policy
+	}
+	if t.HonorLabels {
+		return "keep"
+	}
+	return "prefix"
+}
+
+// addLabels adds the labels to all metrics, except for the labels with a
+// scope, which are only added to the metrics of the families whose name
+// matches their scope. Labels the metrics already have are handled according
+// to the policy returned by conflicts for them.
+func addLabels(metrics map[string]*dto.MetricFamily, labels map[string]string, scopes map[string]*regexp.Regexp, conflicts func(string) string) {
+	for n, mf := range metrics {
+		kept := mf.Metric[:0]
+	metrics:
 		for _, m := range mf.Metric {
+			existing := make(map[string]*dto.LabelPair, len(m.Label))
+			for _, l := range m.Label {
+				existing[l.GetName()] = l
+			}
 			for labelName, labelValue := range labels {
+				if scope, ok := scopes[labelName]; ok && !scope.MatchString(mf.GetName()) {
+					continue
+				}
+				labelName, labelValue := labelName, labelValue
+				if l, ok := existing[labelName]; ok {
+					switch conflicts(labelName) {
+					case "override":
+						l.Value = &labelValue
+						continue
+					case "keep":
+						continue
+					case "drop_metric":
+						continue metrics
+					}
+					name := "exported_" + labelName
+					for existing[name] != nil {
+						name = "exported_" + name
+					}
+					l.Name = &name
+					existing[name] = l
+				}
 				m.Label = append(m.Label, &dto.LabelPair{
 					Name:  &labelName,
 					Value: &labelValue,
 				})
 			}
+			kept = append(kept, m)
+		}
+		mf.Metric = kept
+		if len(mf.Metric) == 0 {
+			delete(metrics, n)
+		}
+	}
+}
+
+// dedupSeries collapses the series of each metric family having the same
+// values for the given labels into one, stripped of all other labels. The
+// values of colliding counters, gauges, untyped metrics and histograms with
+// the same buckets are summed. Other colliding series, e.g. summaries whose
+// quantiles can't be summed, are dropped with an error logged rather than
+// arbitrarily keeping one of them.
+func dedupSeries(metricFamilies map[string]*dto.MetricFamily, labels []string) {
+	keep := map[string]bool{}
+	for _, l := range labels {
+		keep[l] = true
+	}
+	for n, mf := range metricFamilies {
+		sums := map[string]*dto.Metric{}
+		rejected := map[string]bool{}
+		kept := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			key := seriesKey(m, labels)
+			if sum, ok := sums[key]; ok {
+				if !rejected[key] && !sumInto(sum, m) {
+					log.Printf("dropping series %s colliding under merge_labels, as they can't be summed", seriesString(n, sum))
+					rejected[key] = true
+				}
+				continue
+			}
+			sums[key] = m
+			pairs := m.Label[:0]
+			for _, l := range m.Label {
+				if keep[l.GetName()] {
+					pairs = append(pairs, l)
+				}
+			}
+			m.Label = pairs
+			kept = append(kept, m)
+		}
+		if len(rejected) > 0 {
+			accepted := kept[:0]
+			for _, m := range kept {
+				if !rejected[seriesKey(m, labels)] {
+					accepted = append(accepted, m)
+				}
+			}
+			kept = accepted
+		}
+		mf.Metric = kept
+	}
+}
+
+// sumInto adds the value of series m to that of sum, reporting whether they
+// could be summed.
+func sumInto(sum, m *dto.Metric) bool {
+	switch {
+	case sum.Counter != nil && m.Counter != nil:
+		v := sum.Counter.GetValue() + m.Counter.GetValue()
+		sum.Counter.Value = &v
+	case sum.Gauge != nil && m.Gauge != nil:
+		v := sum.Gauge.GetValue() + m.Gauge.GetValue()
+		sum.Gauge.Value = &v
+	case sum.Untyped != nil && m.Untyped != nil:
+		v := sum.Untyped.GetValue() + m.Untyped.GetValue()
+		sum.Untyped.Value = &v
+	case sum.Histogram != nil && m.Histogram != nil:
+		return sumHistogramInto(sum.Histogram, m.Histogram)
+	default:
+		return false
+	}
+	return true
+}
+
+// sumHistogramInto adds the observations of histogram h to sum, reporting
+// whether they could be summed, which is only the case of classic histograms
+// with integer counts and the same bucket boundaries.
+func sumHistogramInto(sum, h *dto.Histogram) bool {
+	if sum.Schema != nil || h.Schema != nil || sum.SampleCountFloat != nil || h.SampleCountFloat != nil {
+		return false
+	}
+	if len(sum.Bucket) != len(h.Bucket) {
+		return false
+	}
+	for i, b := range h.Bucket {
+		if b.GetUpperBound() != sum.Bucket[i].GetUpperBound() || b.CumulativeCountFloat != nil {
+			return false
+		}
+	}
+	for i, b := range h.Bucket {
+		c := sum.Bucket[i].GetCumulativeCount() + b.GetCumulativeCount()
+		sum.Bucket[i].CumulativeCount = &c
+	}
+	count := sum.GetSampleCount() + h.GetSampleCount()
+	sum.SampleCount = &count
+	total := sum.GetSampleSum() + h.GetSampleSum()
+	sum.SampleSum = &total
+	return true
+}
+
+// seriesKey returns the identity of metric m based on the values of the
+// given labels only.
+func seriesKey(m *dto.Metric, labels []string) string {
+	values := make(map[string]string, len(m.Label))
+	for _, l := range m.Label {
+		values[l.GetName()] = l.GetValue()
+	}
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(values[l])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// setTimestamps sets the timestamp of every metric to t.
+func setTimestamps(metricFamilies map[string]*dto.MetricFamily, t time.Time) {
+	ms := t.UnixMilli()
+	for _, mf := range metricFamilies {
+		for _, m := range mf.Metric {
+			m.TimestampMs = &ms
 		}
 	}
 }
 
-func serializeMetrics(w io.Writer, metricFamilies map[string]*dto.MetricFamily) error {
+// familyOrder reports whether metric family a goes before b.
+type familyOrder func(a, b *dto.MetricFamily) bool
+
+// familyOrders are the orders metric families can be serialized in, keyed by
+// the name used to select them. Scrapes are always served in name order, the
+// others are meant for human readers of the debug endpoints.
+var familyOrders = map[string]familyOrder{
+	"name": byName,
+	"type": byType,
+	"help": byHelp,
+}
+
+func byName(a, b *dto.MetricFamily) bool {
+	return a.GetName() < b.GetName()
+}
+
+// byType orders by type, then name.
+func byType(a, b *dto.MetricFamily) bool {
+	if a.GetType() != b.GetType() {
+		return a.GetType() < b.GetType()
+	}
+	return byName(a, b)
+}
+
+// byHelp orders by help text, then name.
+func byHelp(a, b *dto.MetricFamily) bool {
+	if a.GetHelp() != b.GetHelp() {
+		return a.GetHelp() < b.GetHelp()
+	}
+	return byName(a, b)
+}
+
+// serializeMetrics writes the metric families to w in the given format and
+// order. It stops at the first error, e.g. when the client went away, and
+// returns it.
+func serializeMetrics(w io.Writer, format expfmt.Format, order familyOrder, metricFamilies map[string]*dto.MetricFamily) error {
 	lst := make([]*dto.MetricFamily, 0, len(metricFamilies))
 	for _, mf := range metricFamilies {
 		lst = append(lst, mf)
 	}
 	sort.Slice(lst, func(i, j int) bool {
-		return *lst[i].Name < *lst[j].Name
+		return order(lst[i], lst[j])
 	})
-	encoder := expfmt.NewEncoder(w, expfmt.FmtText)
-	for _, mf := range lst {
-		err := encoder.Encode(mf)
-		if err != nil {
-			return err
+	encoder := expfmt.NewEncoder(w, format)
+	for i, mf := range lst {
+		if err := encoder.Encode(mf); err != nil {
+			return fmt.Errorf("stopped after %d of %d metric families: %w", i, len(lst), err)
 		}
 	}
+	// OpenMetrics requires the output to end with # EOF, written on close.
+	if closer, ok := encoder.(expfmt.Closer); ok {
+		return closer.Close()
+	}
 	return nil
 }
 
-// handleMetrics handles the /metrics endpoint by collating metrics from all
-// targets and writing them to the response.
-func handleMetrics(w http.ResponseWriter, r *http.Request) {
-	// Fan out requests to all targets.
-	ch := make(chan map[string]*dto.MetricFamily, len(cfg.Targets))
-	for _, t := range cfg.Targets {
-		go func(t Target) {
-			metricFamilies, err := fetchMetrics(t.URL)
-			defer func() {
-				ch <- metricFamilies
-			}()
-			if err != nil {
-				log.Printf("failed to fetch metrics from %s: %v", t.URL, err)
+// activeTargets returns the statically configured targets along with the ones
+// currently discovered.
+func activeTargets(cfg *Config) []Target {
+	targets := append([]Target(nil), cfg.Targets...)
+	for _, d := range cfg.discoverers {
+		targets = append(targets, cfg.withGlobalLabels(d.Targets())...)
+	}
+	return targets
+}
+
+// scrapeTargets returns the targets to scrape, which is the active targets
+// less the discovered ones left out by sampling.
+func scrapeTargets(cfg *Config) []Target {
+	targets := append([]Target(nil), cfg.Targets...)
+	for _, d := range cfg.discoverers {
+		targets = append(targets, cfg.withGlobalLabels(d.Sample())...)
+	}
+	return targets
+}
+
+// withGlobalLabels returns copies of the discovered targets with the global
+// labels, and instance label if enabled, added. Static targets get them when
+// the config is loaded.
+func (c *Config) withGlobalLabels(targets []Target) []Target {
+	if len(c.Labels) == 0 && !c.InstanceLabel {
+		return targets
+	}
+	labeled := make([]Target, len(targets))
+	for i, t := range targets {
+		t.Labels = c.targetLabels(t)
+		t.labelsSerialized = serializeLabels(t.Labels)
+		labeled[i] = t
+	}
+	return labeled
+}
+
+// targetLabels returns the labels of target t along with the global labels
+// and the instance and job labels, which the labels of t override.
+func (c *Config) targetLabels(t Target) map[string]string {
+	labels := map[string]string{}
+	if c.InstanceLabel {
+		if u, err := url.Parse(t.URL); err == nil {
+			// Like Prometheus, the port is made explicit.
+			instance := u.Host
+			if u.Port() == "" && u.Scheme == "https" {
+				instance = net.JoinHostPort(u.Hostname(), "443")
+			} else if u.Port() == "" {
+				instance = net.JoinHostPort(u.Hostname(), "80")
+			}
+			labels["instance"] = instance
+		}
+	}
+	if t.Job != "" {
+		labels["job"] = t.Job
+	}
+	return mergeLabels(mergeLabels(c.Labels, labels), t.Labels)
+}
+
+// mergeLabels returns the labels of base overridden by those of override.
+func mergeLabels(base, override map[string]string) map[string]string {
+	labels := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		labels[k] = v
+	}
+	for k, v := range override {
+		labels[k] = v
+	}
+	return labels
+}
+
+// errScrapeDeadline is the error of targets not scraped by the deadline.
+var errScrapeDeadline = errors.New("scrape deadline exceeded")
+
+// scrapeResult is the outcome of scraping a target.
+type scrapeResult struct {
+	target         Target
+	metricFamilies map[string]*dto.MetricFamily
+	err            error
+	duration       time.Duration
+}
+
+// scrapeTarget fetches and transforms the metrics of target t. A panic, e.g.
+// from malformed input, is recovered from and fails the scrape of the target
+// alone.
+func scrapeTarget(ctx context.Context, t Target) (res scrapeResult) {
+	concurrentScrapes.Inc()
+	defer concurrentScrapes.Dec()
+	start := time.Now()
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic while scraping %s: %v\n%s", t.URL, p, debug.Stack())
+			res = scrapeResult{
+				target:   t,
+				err:      fmt.Errorf("panic: %v", p),
+				duration: time.Since(start),
 			}
-			addLabels(metricFamilies, t.Labels)
-		}(t)
+		}
+	}()
+	if !breakerAllows(t) {
+		return scrapeResult{target: t, err: errBreakerOpen}
+	}
+	metricFamilies, err := fetchMetricsCached(ctx, t)
+	if err != nil {
+		warnf("failed to fetch metrics from %s: %v", t.URL, err)
+	}
+	// Scrapes cut short by the client or the deadline say nothing about the
+	// health of the target.
+	if ctx.Err() == nil {
+		recordBreaker(t, err)
+	}
+	metricFamilies, lerr := processMetrics(t, metricFamilies)
+	if err == nil {
+		err = lerr
+	}
+	return scrapeResult{
+		target:         t,
+		metricFamilies: metricFamilies,
+		err:            err,
+		duration:       time.Since(start),
 	}
+}
+
+// collateMetrics scrapes the targets of group, or all targets if group is
+// empty, and merges their metrics, returning the merged metric families and
+// the outcome of scraping each target.
+func collateMetrics(ctx context.Context, group string) (map[string]*dto.MetricFamily, []scrapeResult) {
+	cfg := currentConfig()
+	results := scrapeGroup(ctx, cfg, group)
+	return mergeResults(cfg, results, group), results
+}
+
+// scrapeGroup scrapes the targets of group, or all targets if group is empty,
+// returning the outcome of scraping each. Fetches still outstanding when ctx
+// is done or the scrape deadline is reached are canceled.
+func scrapeGroup(ctx context.Context, cfg *Config, group string) []scrapeResult {
+	start := time.Now()
+	var cancel context.CancelFunc
+	if cfg.ScrapeDeadline > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.ScrapeDeadline)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	// Fan out requests to all targets. Groups only have static targets, so
+	// discoverers aren't sampled for them, which would otherwise move their
+	// rotation forward on every group scrape.
+	var targets []Target
+	if group == "" {
+		targets = scrapeTargets(cfg)
+	} else {
+		for _, t := range cfg.Targets {
+			if t.group == group {
+				targets = append(targets, t)
+			}
+		}
+	}
+	type indexedResult struct {
+		i   int
+		res scrapeResult
+	}
+	ch := make(chan indexedResult, len(targets))
+	var sem chan struct{}
+	if cfg.MaxConcurrentFetches > 0 {
+		sem = make(chan struct{}, cfg.MaxConcurrentFetches)
+	}
+	for i, t := range targets {
+		go func(i int, t Target) {
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					ch <- indexedResult{i, scrapeResult{target: t, err: ctx.Err()}}
+					return
+				}
+			}
+			ch <- indexedResult{i, scrapeTarget(ctx, t)}
+		}(i, t)
+	}
+	var deadline <-chan time.Time
+	if cfg.ScrapeDeadline > 0 {
+		timer := time.NewTimer(cfg.ScrapeDeadline)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	results := make([]scrapeResult, len(targets))
+	done := make([]bool, len(targets))
+collect:
+	for range targets {
+		select {
+		case ir := <-ch:
+			results[ir.i] = ir.res
+			done[ir.i] = true
+		case <-deadline:
+			break collect
+		}
+	}
+	// Targets which didn't make the deadline are still accounted for so that
+	// their outcome shows in the exporter's own metrics.
+	for i, t := range targets {
+		if !done[i] {
+			warnf("failed to fetch metrics from %s: scrape deadline exceeded", t.URL)
+			results[i] = scrapeResult{
+				target:   t,
+				err:      errScrapeDeadline,
+				duration: cfg.ScrapeDeadline,
+			}
+		}
+	}
+	recordTargetStatuses(cfg, start, results)
+	return results
+}
+
+// mergeResults merges the metrics of the scraped targets of group along with
+// those describing the outcome of scraping them. The exporter's own metrics
+// are added when merging all targets, unless served on the telemetry_path.
+func mergeResults(cfg *Config, results []scrapeResult, group string) map[string]*dto.MetricFamily {
+	aliasCollisions(results)
 	allMetricsFamilies := map[string]*dto.MetricFamily{}
-	for range cfg.Targets {
-		for n, mf := range <-ch {
+	for _, res := range results {
+		for n, mf := range res.metricFamilies {
 			if amf, ok := allMetricsFamilies[n]; ok {
 				amf.Metric = append(amf.Metric, mf.Metric...)
 			} else {
@@ -134,24 +1592,187 @@ func handleMetrics(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
-	if err := serializeMetrics(w, allMetricsFamilies); err != nil {
-		log.Printf("failed to serialize metrics: %v", err)
+	transformMerged(cfg, allMetricsFamilies)
+	if len(cfg.MergeLabels) > 0 {
+		dedupSeries(allMetricsFamilies, cfg.MergeLabels)
+	}
+	var selfMetricFamilies []*dto.MetricFamily
+	if cfg.TelemetryPath == "" && group == "" {
+		var err error
+		selfMetricFamilies, err = registry.Gather()
+		if err != nil {
+			log.Printf("failed to gather own metrics: %v", err)
+		}
 	}
+	selfMetricFamilies = append(selfMetricFamilies, targetMetrics(results)...)
+	for _, mf := range selfMetricFamilies {
+		allMetricsFamilies[mf.GetName()] = mf
+	}
+	return allMetricsFamilies
+}
+
+// transformMerged applies the transformations configured for all targets to
+// their merged metric families.
+func transformMerged(cfg *Config, metricFamilies map[string]*dto.MetricFamily) {
+	if len(cfg.seriesDropLabels) > 0 {
+		dropMatchingLabels(metricFamilies, cfg.seriesDropLabels)
+	}
+	if len(cfg.LabelMap) > 0 {
+		mapLabelValues(metricFamilies, cfg.LabelMap)
+	}
+}
+
+// countSeries returns the number of series collected from targets.
+func countSeries(results []scrapeResult) int {
+	n := 0
+	for _, res := range results {
+		for _, mf := range res.metricFamilies {
+			n += len(mf.Metric)
+		}
+	}
+	return n
+}
+
+// handleMetrics handles the /metrics endpoint by collating metrics from all
+// targets and writing them to the response.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	group := strings.TrimPrefix(r.URL.Path, "/metrics/")
+	if group == r.URL.Path {
+		group = ""
+	} else if !cfg.hasGroup(group) {
+		http.NotFound(w, r)
+		return
+	}
+	allMetricsFamilies, results, scrapeTime := gatherMetrics(r.Context(), group)
+	if cfg.EmptyResponseStatus != http.StatusOK && countSeries(results) == 0 {
+		http.Error(w, "no metrics collected from any target", cfg.EmptyResponseStatus)
+		if cfg.DebugEndpoints {
+			recordReport(scrapeTime, results, 0)
+		}
+		return
+	}
+	if cfg.ValidateOutput {
+		if err := validateMetrics(allMetricsFamilies); err != nil {
+			log.Printf("not serving metrics: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if cfg.DebugEndpoints {
+		recordMetadata(allMetricsFamilies)
+	}
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	cw := &countingWriter{w: w}
+	var gw *gzip.Writer
+	var out io.Writer = cw
+	if cfg.Gzip {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			// The level is validated when loading the config.
+			gw, _ = gzip.NewWriterLevel(cw, cfg.GzipLevel)
+			out = gw
+		}
+	}
+	err := serializeMetrics(out, format, byName, allMetricsFamilies)
+	if gw != nil {
+		if cerr := gw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		warnf("failed to write metrics to %s: %v", r.RemoteAddr, err)
+	}
+	responseBytesTotal.Add(float64(cw.n))
+	if cfg.DebugEndpoints {
+		recordReport(scrapeTime, results, cw.n)
+	}
+}
+
+// acceptsGzip reports whether the client accepts gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		v, err := strconv.ParseFloat(q, 64)
+		return err == nil && v > 0
+	}
+	return false
 }
 
 func main() {
-	var err error
 	log.SetFlags(0)
 	log.SetPrefix("prometheus-unified-exporter: ")
-	configPath := os.Getenv("PUE_CONFIG")
-	if configPath == "" {
-		log.Fatal("PUE_CONFIG env var must be set to the path of the config file")
+	configPath := flag.String("config", os.Getenv("PUE_CONFIG"), "path of the config file, defaulting to the PUE_CONFIG env var")
+	flag.StringVar(&listenOverride, "listen", "", "address to listen on, overriding the config")
+	logLevel := flag.String("log-level", "info", "level below which messages aren't logged: info, warn or error")
+	flag.StringVar(&configFormat, "config-format", "", "format of config files: yaml, json or toml, by default told by their extension")
+	check := flag.Bool("check-config", false, "validate the config and exit, with a non-zero status if it's invalid")
+	once := flag.Bool("once", false, "scrape all targets once, write the metrics to --output and exit")
+	output := flag.String("output", "", "file to write the metrics to with --once, stdout by default")
+	flag.Parse()
+	if err := setLogLevel(*logLevel); err != nil {
+		log.Fatal(err)
+	}
+	if *configPath == "" {
+		log.Fatal("--config or the PUE_CONFIG env var must be set to the path of the config file")
 	}
-	cfg, err = loadConfig(configPath)
+	if *check {
+		if err := checkConfig(*configPath); err != nil {
+			log.Fatalf("invalid config: %v", err)
+		}
+		fmt.Println("config is valid")
+		return
+	}
+	cfg, err := loadConfig(*configPath)
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
 	}
-	http.HandleFunc("/metrics", handleMetrics)
-	log.Printf("listening on http://%s/metrics", cfg.Listen)
-	log.Fatal(http.ListenAndServe(cfg.Listen, nil))
+	applyConfig(cfg)
+	if *once {
+		if err := scrapeOnce(*output); err != nil {
+			log.Fatalf("failed to write metrics: %v", err)
+		}
+		return
+	}
+	go reloadOnSIGHUP(*configPath)
+	if cfg.ScrapeInterval > 0 {
+		go scrapeInBackground()
+	}
+	activeMux.Store(newMux(cfg, *configPath))
+	if cfg.PprofListen != "" {
+		go servePprof(cfg.PprofListen)
+	}
+	if cfg.TLS == nil {
+		infof("listening on http://%s/metrics", cfg.Listen)
+		log.Fatal(http.ListenAndServe(cfg.Listen, http.HandlerFunc(serveActiveMux)))
+	}
+	certs := &certReloader{certFile: cfg.TLS.CertFile, keyFile: cfg.TLS.KeyFile}
+	if _, err := certs.GetCertificate(nil); err != nil {
+		log.Fatalf("failed to load TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{GetCertificate: certs.GetCertificate}
+	if cfg.TLS.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.TLS.ClientCAFile)
+		if err != nil {
+			log.Fatalf("failed to load client CAs: %v", err)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	server := &http.Server{
+		Addr:      cfg.Listen,
+		Handler:   http.HandlerFunc(serveActiveMux),
+		TLSConfig: tlsConfig,
+	}
+	infof("listening on https://%s/metrics", cfg.Listen)
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }
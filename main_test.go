@@ -0,0 +1,2049 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// writeTestConfig writes config to a file and returns its path.
+func writeTestConfig(t testing.TB, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadTestConfig loads config and makes it the config in effect for the
+// duration of the test.
+func loadTestConfig(t testing.TB, config string) *Config {
+	t.Helper()
+	cfg, err := loadConfig(writeTestConfig(t, config))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	old := activeConfig.Swap(cfg)
+	t.Cleanup(func() { activeConfig.Store(old) })
+	return cfg
+}
+
+// parseText parses metric families in the text format.
+func parseText(t *testing.T, text string) map[string]*dto.MetricFamily {
+	t.Helper()
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("failed to parse metrics: %v", err)
+	}
+	return mfs
+}
+
+// formatText returns metric families in the text format, with the labels of
+// each series sorted by name so that the output is stable.
+func formatText(t *testing.T, mfs map[string]*dto.MetricFamily) string {
+	t.Helper()
+	sorted := cloneMetricFamilies(mfs)
+	for _, mf := range sorted {
+		for _, m := range mf.Metric {
+			sort.Slice(m.Label, func(i, j int) bool {
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+		}
+	}
+	var b bytes.Buffer
+	if err := serializeMetrics(&b, expfmt.FmtText, byName, sorted); err != nil {
+		t.Fatalf("failed to serialize metrics: %v", err)
+	}
+	return b.String()
+}
+
+// metricsHandler serves the metric families in the format negotiated with
+// the client.
+func metricsHandler(t *testing.T, mfs ...*dto.MetricFamily) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		enc := expfmt.NewEncoder(w, format)
+		for _, mf := range mfs {
+			if err := enc.Encode(mf); err != nil {
+				t.Errorf("failed to encode metrics: %v", err)
+			}
+		}
+		if closer, ok := enc.(expfmt.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// serveMetrics starts a target serving the metric families.
+func serveMetrics(t *testing.T, mfs ...*dto.MetricFamily) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(metricsHandler(t, mfs...))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestNativeHistogramPassthrough(t *testing.T) {
+	tests := []struct {
+		name      string
+		histogram *dto.Histogram
+	}{
+		{
+			name: "integer counts",
+			histogram: &dto.Histogram{
+				SampleCount:   proto.Uint64(12),
+				SampleSum:     proto.Float64(3.5),
+				Schema:        proto.Int32(3),
+				ZeroThreshold: proto.Float64(1e-128),
+				ZeroCount:     proto.Uint64(2),
+				PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(2)}, {Offset: proto.Int32(3), Length: proto.Uint32(1)}},
+				PositiveDelta: []int64{4, -1, 2},
+				NegativeSpan:  []*dto.BucketSpan{{Offset: proto.Int32(-1), Length: proto.Uint32(1)}},
+				NegativeDelta: []int64{1},
+			},
+		},
+		{
+			name: "float counts",
+			histogram: &dto.Histogram{
+				SampleCountFloat: proto.Float64(7.5),
+				SampleSum:        proto.Float64(-2),
+				Schema:           proto.Int32(-1),
+				ZeroThreshold:    proto.Float64(0.001),
+				ZeroCountFloat:   proto.Float64(0.5),
+				PositiveSpan:     []*dto.BucketSpan{{Offset: proto.Int32(1), Length: proto.Uint32(2)}},
+				PositiveCount:    []float64{3, 4},
+			},
+		},
+		{
+			name: "with classic buckets",
+			histogram: &dto.Histogram{
+				SampleCount:   proto.Uint64(3),
+				SampleSum:     proto.Float64(0.75),
+				Bucket:        []*dto.Bucket{{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(2)}, {UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(3)}},
+				Schema:        proto.Int32(0),
+				ZeroThreshold: proto.Float64(1e-128),
+				PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(-1), Length: proto.Uint32(2)}},
+				PositiveDelta: []int64{2, -1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			want := &dto.MetricFamily{
+				Name:   proto.String("rpc_duration_seconds"),
+				Help:   proto.String("RPC latency."),
+				Type:   dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{{Histogram: tt.histogram}},
+			}
+			srv := serveMetrics(t, want)
+			loadTestConfig(t, "targets:\n  - url: "+srv.URL+"\n")
+
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+			rec := httptest.NewRecorder()
+			handleMetrics(rec, req)
+
+			dec := expfmt.NewDecoder(rec.Body, expfmt.ResponseFormat(rec.Header()))
+			for {
+				var mf dto.MetricFamily
+				if err := dec.Decode(&mf); err == io.EOF {
+					t.Fatal("native histogram missing from the response")
+				} else if err != nil {
+					t.Fatalf("failed to decode response: %v", err)
+				}
+				if mf.GetName() == want.GetName() {
+					if !proto.Equal(&mf, want) {
+						t.Errorf("got %v, want %v", &mf, want)
+					}
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestScrapeProtocol(t *testing.T) {
+	tests := []struct {
+		name       string
+		protocol   string
+		wantAccept string
+	}{
+		{name: "default", wantAccept: acceptHeader},
+		{name: "text", protocol: "text", wantAccept: `text/plain;version=0.0.4`},
+		{name: "openmetrics", protocol: "openmetrics", wantAccept: `application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1`},
+		{name: "protobuf", protocol: "protobuf", wantAccept: `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited`},
+	}
+	want := &dto.MetricFamily{
+		Name:   proto.String("up_since_seconds"),
+		Help:   proto.String("Start time."),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1.7e9)}}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			accept := make(chan string, 1)
+			h := metricsHandler(t, want)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				accept <- r.Header.Get("Accept")
+				h(w, r)
+			}))
+			defer srv.Close()
+			cfg := loadTestConfig(t, "targets:\n  - url: "+srv.URL+"\n    scrape_protocol: "+tt.protocol+"\n")
+
+			mfs, err := fetchMetrics(context.Background(), cfg.Targets[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := <-accept; got != tt.wantAccept {
+				t.Errorf("got Accept %q, want %q", got, tt.wantAccept)
+			}
+			if got := mfs[want.GetName()]; !proto.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeOpenMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "families",
+			input: `# HELP requests Requests \"served\".
+# TYPE requests counter
+# UNIT requests requests
+requests_total{path="/a{b}"} 3 # {trace_id="abc"} 1 1.7e9
+requests_created{path="/a{b}"} 1.6e9
+# TYPE build info
+build_info{version="1.0"} 1
+# TYPE queue gaugehistogram
+queue_bucket{le="+Inf"} 4
+queue_gcount 4
+queue_gsum 10
+# TYPE temp gauge
+temp 21.5 1700000000.25
+# TYPE other unknown
+other 1
+# EOF
+`,
+			want: `# TYPE build_info gauge
+build_info{version="1.0"} 1
+# TYPE other untyped
+other 1
+# TYPE queue histogram
+queue_bucket{le="+Inf"} 4
+queue_sum 10
+queue_count 4
+# HELP requests_total Requests "served".
+# TYPE requests_total counter
+requests_total{path="/a{b}"} 3
+# TYPE temp gauge
+temp 21.5 1700000000250
+`,
+		},
+		{
+			name:  "HELP after TYPE",
+			input: "# TYPE up gauge\n# HELP up Up.\nup 1\n# EOF",
+			want:  "# HELP up Up.\n# TYPE up gauge\nup 1\n",
+		},
+		{
+			name:    "missing EOF",
+			input:   "# TYPE up gauge\nup 1\n",
+			wantErr: true,
+		},
+		{
+			name:    "content after EOF",
+			input:   "# TYPE up gauge\nup 1\n# EOF\nup 2\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			mfs, err := decodeMetrics(strings.NewReader(tt.input), expfmt.FmtOpenMetrics)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got no error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatText(t, mfs); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// testCert returns a self-signed certificate for commonName and dnsNames,
+// valid until notAfter, and its key, PEM encoded.
+func testCert(t *testing.T, commonName string, dnsNames []string, notAfter time.Time) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeTestCert writes a certificate and key made by testCert to certFile
+// and keyFile, with their modification time set to modTime.
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	certPEM, keyPEM := testCert(t, commonName, nil, time.Now().Add(time.Hour))
+	for file, b := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		if err := os.WriteFile(file, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	writeTestCert(t, certFile, keyFile, "first", now)
+	certs := &certReloader{certFile: certFile, keyFile: keyFile}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: certs.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.NotFoundHandler())
+	// served returns the common name of the certificate served to a new
+	// connection.
+	served := func() string {
+		t.Helper()
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if got := served(); got != "first" {
+		t.Errorf("got certificate %q, want first", got)
+	}
+	writeTestCert(t, certFile, keyFile, "second", now.Add(time.Second))
+	if got := served(); got != "second" {
+		t.Errorf("got certificate %q after rotating, want second", got)
+	}
+	// A certificate midway through being rotated doesn't load, so the
+	// previous one is kept.
+	if err := os.WriteFile(certFile, []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(certFile, now.Add(2*time.Second), now.Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := served(); got != "second" {
+		t.Errorf("got certificate %q while rotating, want second", got)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# HELP requests_total Requests served.\n# TYPE requests_total counter\nrequests_total 3\n# HELP temp Temperature.\n# TYPE temp gauge\ntemp 21\n")
+	}))
+	defer srv.Close()
+	loadTestConfig(t, "debug_endpoints: true\ntargets:\n  - url: "+srv.URL+"\n")
+	handleMetrics(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	// listed returns the metadata listed by the endpoint at path.
+	listed := func(path string) map[string][]metadata {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleMetadata(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp struct {
+			Status string                `json:"status"`
+			Data   map[string][]metadata `json:"data"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != "success" {
+			t.Errorf("got status %q, want success", resp.Status)
+		}
+		return resp.Data
+	}
+
+	md := listed("/api/v1/metadata")
+	for name, want := range map[string]metadata{
+		"requests_total": {Type: "counter", Help: "Requests served."},
+		"temp":           {Type: "gauge", Help: "Temperature."},
+		"pue_target_up":  {Type: "gauge", Help: "Whether the target was scraped successfully."},
+	} {
+		if got := md[name]; len(got) != 1 || got[0] != want {
+			t.Errorf("got metadata %v of %s, want %v", got, name, want)
+		}
+	}
+	want := map[string][]metadata{"temp": {{Type: "gauge", Help: "Temperature."}}}
+	if got := listed("/api/v1/metadata?metric=temp"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got metadata %v of temp only, want %v", got, want)
+	}
+}
+
+func TestTimestampSamples(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE a gauge\na{i=\"1\"} 1\na{i=\"2\"} 2 1000\n")
+	}))
+	defer srv.Close()
+	// scrape returns the metrics served with config, and the time range in
+	// milliseconds of the request.
+	scrape := func(config string) (map[string]*dto.MetricFamily, int64, int64) {
+		loadTestConfig(t, config+"targets:\n  - url: "+srv.URL+"\n")
+		before := time.Now().UnixMilli()
+		rec := httptest.NewRecorder()
+		handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return parseText(t, rec.Body.String()), before, time.Now().UnixMilli()
+	}
+
+	// By default, timestamps of targets are passed through.
+	mfs, _, _ := scrape("")
+	for _, m := range mfs["a"].Metric {
+		want := int64(0)
+		if m.Label[0].GetValue() == "2" {
+			want = 1000
+		}
+		if got := m.GetTimestampMs(); got != want {
+			t.Errorf("got timestamp %d of %s, want %d", got, seriesString("a", m), want)
+		}
+	}
+	// Otherwise every series, the exporter's own included, is given the time
+	// of the scrape.
+	mfs, before, after := scrape("timestamp_samples: true\n")
+	want := mfs["a"].Metric[0].GetTimestampMs()
+	if want < before || want > after {
+		t.Fatalf("got timestamp %d, want one between %d and %d", want, before, after)
+	}
+	for name, mf := range mfs {
+		for _, m := range mf.Metric {
+			if got := m.GetTimestampMs(); got != want {
+				t.Errorf("got timestamp %d of %s, want %d", got, seriesString(name, m), want)
+			}
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE a gauge\na{i=\"1\"} 1\na{i=\"2\"} 2\n")
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	loadTestConfig(t, "debug_endpoints: true\ntargets:\n  - url: "+up.URL+"\n  - url: "+down.URL+"\n")
+	metrics := httptest.NewRecorder()
+	handleMetrics(metrics, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	rec := httptest.NewRecorder()
+	handleReport(rec, httptest.NewRequest(http.MethodGet, "/report?format=json", nil))
+	var report scrapeReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := report.OutputBytes, int64(metrics.Body.Len()); got != want {
+		t.Errorf("got %d output bytes, want %d", got, want)
+	}
+	targets := map[string]targetReport{}
+	for _, tr := range report.Targets {
+		targets[tr.URL] = tr
+	}
+	if tr := targets[up.URL]; !tr.Up || tr.Samples != 2 || tr.Error != "" {
+		t.Errorf("got report %+v of %s, want up with 2 samples", tr, up.URL)
+	}
+	if tr := targets[down.URL]; tr.Up || tr.Samples != 0 || !strings.Contains(tr.Error, "500") {
+		t.Errorf("got report %+v of %s, want down with a 500 error", tr, down.URL)
+	}
+
+	rec = httptest.NewRecorder()
+	handleReport(rec, httptest.NewRequest(http.MethodGet, "/report", nil))
+	for _, want := range []string{up.URL + "  up ", down.URL + "  down "} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("got report\n%s\nwant a line starting %q", rec.Body, want)
+		}
+	}
+}
+
+// counterValue returns the current value of c.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// gaugeValue returns the current value of g.
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestScrapePanic(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE a gauge\na 1\n")
+	})
+	good := httptest.NewServer(handler)
+	defer good.Close()
+	bad := httptest.NewServer(handler)
+	defer bad.Close()
+	cfg := loadTestConfig(t, "targets:\n  - url: "+good.URL+"\n  - url: "+bad.URL+"\n")
+	// A relabel rule without its compiled regex panics when applied, like a
+	// bug triggered by the metrics of one target would.
+	cfg.Targets[1].metricRelabel = []relabelRule{{RelabelConfig: RelabelConfig{Action: "replace", SourceLabels: []string{"__name__"}, TargetLabel: "x"}}}
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	mfs := parseText(t, rec.Body.String())
+	if got := len(mfs["a"].GetMetric()); got != 1 {
+		t.Errorf("got %d series of a, want 1 from the target that didn't panic", got)
+	}
+	up := map[string]float64{}
+	for _, m := range mfs["pue_target_up"].GetMetric() {
+		for _, l := range m.Label {
+			if l.GetName() == "instance" {
+				up[l.GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	if want := map[string]float64{good.URL: 1, bad.URL: 0}; !reflect.DeepEqual(up, want) {
+		t.Errorf("got pue_target_up by instance %v, want %v", up, want)
+	}
+}
+
+func TestHighWaterMarks(t *testing.T) {
+	const n = 4
+	// Each target answers only once all are being scraped, so that n scrapes
+	// and connections are in flight at once.
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	var config strings.Builder
+	config.WriteString("targets:\n")
+	for i := 0; i < n; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			arrived.Done()
+			arrived.Wait()
+			fmt.Fprint(w, "# TYPE a gauge\na 1\n")
+		}))
+		defer srv.Close()
+		fmt.Fprintf(&config, "  - url: %s\n", srv.URL)
+	}
+	loadTestConfig(t, config.String())
+	oldScrapes, oldConnections := concurrentScrapes, openConnections
+	concurrentScrapes = newHighWaterMark(prometheus.GaugeOpts{Name: "scrapes"})
+	openConnections = newHighWaterMark(prometheus.GaugeOpts{Name: "connections"})
+	defer func() { concurrentScrapes, openConnections = oldScrapes, oldConnections }()
+
+	for i := 0; i < 2; i++ {
+		handleMetrics(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		arrived.Add(n)
+	}
+	// The marks hold the highest counts seen rather than the current ones.
+	if got := gaugeValue(t, concurrentScrapes.gauge); got != n {
+		t.Errorf("got max concurrent scrapes %v, want %d", got, n)
+	}
+	if got := gaugeValue(t, openConnections.gauge); got != n {
+		t.Errorf("got max open connections %v, want %d", got, n)
+	}
+}
+
+func TestScrapeDeadline(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE a gauge\na 1\n")
+	}))
+	defer fast.Close()
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	loadTestConfig(t, "scrape_deadline: 100ms\ntargets:\n  - url: "+fast.URL+"\n  - url: "+hung.URL+"\n")
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s, want the scrape cut short by scrape_deadline", elapsed)
+	}
+	mfs := parseText(t, rec.Body.String())
+	if got := len(mfs["a"].GetMetric()); got != 1 {
+		t.Errorf("got %d series of a, want 1 from the target that made the deadline", got)
+	}
+	// Self-metrics cover every target, including the one that didn't finish.
+	for _, name := range []string{"pue_target_up", "pue_target_scrape_duration_seconds"} {
+		values := map[string]float64{}
+		for _, m := range mfs[name].GetMetric() {
+			for _, l := range m.Label {
+				if l.GetName() == "instance" {
+					values[l.GetValue()] = m.GetGauge().GetValue()
+				}
+			}
+		}
+		if len(values) != 2 {
+			t.Errorf("got %s of %v, want both targets", name, values)
+		}
+		if name == "pue_target_up" && (values[fast.URL] != 1 || values[hung.URL] != 0) {
+			t.Errorf("got %s of %v, want 1 for %s and 0 for %s", name, values, fast.URL, hung.URL)
+		}
+	}
+}
+
+func TestDedupSeries(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name: "counters and gauges summed",
+			input: `# TYPE requests_total counter
+requests_total{job="api",pod="a"} 1
+requests_total{job="api",pod="b"} 2
+requests_total{job="web",pod="c"} 4
+# TYPE inflight gauge
+inflight{job="api",pod="a"} 3
+inflight{job="api",pod="b"} 5
+`,
+			want: `# TYPE inflight gauge
+inflight{job="api"} 8
+# TYPE requests_total counter
+requests_total{job="api"} 3
+requests_total{job="web"} 4
+`,
+		},
+		{
+			name: "histograms summed",
+			input: `# TYPE latency histogram
+latency_bucket{job="api",pod="a",le="1"} 1
+latency_bucket{job="api",pod="a",le="+Inf"} 2
+latency_sum{job="api",pod="a"} 3
+latency_count{job="api",pod="a"} 2
+latency_bucket{job="api",pod="b",le="1"} 4
+latency_bucket{job="api",pod="b",le="+Inf"} 4
+latency_sum{job="api",pod="b"} 1
+latency_count{job="api",pod="b"} 4
+`,
+			want: `# TYPE latency histogram
+latency_bucket{job="api",le="1"} 5
+latency_bucket{job="api",le="+Inf"} 6
+latency_sum{job="api"} 4
+latency_count{job="api"} 6
+`,
+		},
+		{
+			name: "summaries dropped",
+			input: `# TYPE rpc summary
+rpc{job="api",pod="a",quantile="0.5"} 1
+rpc_sum{job="api",pod="a"} 1
+rpc_count{job="api",pod="a"} 1
+rpc{job="api",pod="b",quantile="0.5"} 2
+rpc_sum{job="api",pod="b"} 2
+rpc_count{job="api",pod="b"} 1
+rpc{job="web",pod="c",quantile="0.5"} 3
+rpc_sum{job="web",pod="c"} 3
+rpc_count{job="web",pod="c"} 1
+`,
+			want: `# TYPE rpc summary
+rpc{job="web",quantile="0.5"} 3
+rpc_sum{job="web"} 3
+rpc_count{job="web"} 1
+`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			mfs := parseText(t, tt.input)
+			dedupSeries(mfs, []string{"job"})
+			if got := formatText(t, mfs); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+
+			// Colliding series used to be resolved by keeping the first, so
+			// the output depends on their order.
+			reversed := parseText(t, tt.input)
+			for _, mf := range reversed {
+				for i, j := 0, len(mf.Metric)-1; i < j; i, j = i+1, j-1 {
+					mf.Metric[i], mf.Metric[j] = mf.Metric[j], mf.Metric[i]
+				}
+			}
+			dedupSeries(reversed, []string{"job"})
+			for n, mf := range reversed {
+				sort.Slice(mf.Metric, func(i, j int) bool {
+					return seriesString(n, mf.Metric[i]) < seriesString(n, mf.Metric[j])
+				})
+			}
+			if got := formatText(t, reversed); got != tt.want {
+				t.Errorf("got with series reversed\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		trace   bool
+		handler http.HandlerFunc
+		// want is matched against the log, empty for no phase breakdown.
+		want string
+	}{
+		{
+			name:  "slow first byte",
+			trace: true,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			want: `timed out after .*: connect=\S+ first_byte=incomplete after `,
+		},
+		{
+			name:  "slow body",
+			trace: true,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "# TYPE a gauge\n")
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			},
+			want: `timed out after .*: connect=\S+ first_byte=\S+ body=`,
+		},
+		{
+			name: "disabled",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			cfg := loadTestConfig(t, fmt.Sprintf("trace_timeouts: %t\ntargets:\n  - url: %s\n    timeout: 100ms\n", tt.trace, srv.URL))
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+
+			_, err := fetchMetrics(context.Background(), cfg.Targets[0])
+			log.SetOutput(os.Stderr)
+			if err == nil {
+				t.Fatal("got no error, want a timeout")
+			}
+			if tt.want == "" {
+				if strings.Contains(logged.String(), "timed out after") {
+					t.Errorf("got log\n%s\nwant no phase breakdown", logged.String())
+				}
+				return
+			}
+			if !regexp.MustCompile(tt.want).MatchString(logged.String()) {
+				t.Errorf("got log\n%s\nwant a match of %q", logged.String(), tt.want)
+			}
+		})
+	}
+}
+
+// failingWriter accepts the first ok writes and fails all others, counting
+// them.
+type failingWriter struct {
+	http.ResponseWriter
+	ok     int
+	failed int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.ok > 0 {
+		w.ok--
+		return len(p), nil
+	}
+	w.failed++
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestSerializeMetricsWriteError(t *testing.T) {
+	mfs := parseText(t, "# TYPE a gauge\na 1\n# TYPE b gauge\nb 2\n# TYPE c gauge\nc 3\n")
+	w := &failingWriter{ok: 1}
+	err := serializeMetrics(w, expfmt.FmtText, byName, mfs)
+	if err == nil || !strings.Contains(err.Error(), "stopped after 1 of 3 metric families") {
+		t.Errorf("got error %v, want one stopping after the first family", err)
+	}
+	if w.failed != 1 {
+		t.Errorf("got %d failed writes, want encoding to stop at the first", w.failed)
+	}
+
+	// handleMetrics logs the error once.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fleetBody(10))
+	}))
+	defer srv.Close()
+	loadTestConfig(t, fleetConfig(srv, 10, ""))
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	w = &failingWriter{ResponseWriter: httptest.NewRecorder(), ok: 1}
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	log.SetOutput(os.Stderr)
+	if got := strings.Count(logged.String(), "failed to write metrics"); got != 1 {
+		t.Errorf("got %d write errors logged, want 1:\n%s", got, logged.String())
+	}
+	if w.failed != 1 {
+		t.Errorf("got %d failed writes, want writing to stop at the first", w.failed)
+	}
+}
+
+func TestNestedExporter(t *testing.T) {
+	leaf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE requests_total counter\nrequests_total 7\n")
+	}))
+	defer leaf.Close()
+	// The nested exporter serves what this one would for the leaf target.
+	loadTestConfig(t, "targets:\n  - url: "+leaf.URL+"\n")
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	nestedBody := rec.Body.Bytes()
+	nested := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(nestedBody)
+	}))
+	defer nested.Close()
+	loadTestConfig(t, "targets:\n  - url: "+nested.URL+"\n    nested: true\n    labels: {region: eu}\n")
+
+	rec = httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	mfs := parseText(t, rec.Body.String())
+	if got := mfs["requests_total"].GetMetric(); len(got) != 1 || got[0].GetCounter().GetValue() != 7 {
+		t.Errorf("got requests_total %v, want the one series of the leaf", got)
+	}
+	// instances returns the instance labels of the series of the family.
+	instances := func(name string) []string {
+		var got []string
+		for _, m := range mfs[name].GetMetric() {
+			for _, l := range m.Label {
+				if l.GetName() == "instance" {
+					got = append(got, l.GetValue())
+				}
+			}
+		}
+		return got
+	}
+	// The self-metrics of each exporter describe its own targets.
+	if got, want := instances("pue_target_up"), []string{nested.URL}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got pue_target_up of %v, want %v", got, want)
+	}
+	if got, want := instances("pue_nested_target_up"), []string{leaf.URL}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got pue_nested_target_up of %v, want %v", got, want)
+	}
+	for _, m := range mfs["pue_nested_target_up"].GetMetric() {
+		if !hasLabel(m, "region", "eu") {
+			t.Errorf("got %s, want it labeled as from the nested exporter", seriesString("pue_nested_target_up", m))
+		}
+	}
+}
+
+// hasLabel reports whether series m has the label name with value.
+func hasLabel(m *dto.Metric, name, value string) bool {
+	for _, l := range m.Label {
+		if l.GetName() == name && l.GetValue() == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDropLabels(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE a gauge\na 1\n")
+	}))
+	defer srv.Close()
+	loadTestConfig(t, fmt.Sprintf(`labels: {env: prod, dc: east}
+targets:
+  - url: %[1]s/kept
+    labels: {name: kept}
+  - url: %[1]s/dropped
+    labels: {name: dropped}
+    drop_labels: [env]
+`, srv.URL))
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	mfs := parseText(t, rec.Body.String())
+	for _, family := range []string{"a", "pue_target_up"} {
+		if got := len(mfs[family].GetMetric()); got != 2 {
+			t.Fatalf("got %d series of %s, want 2", got, family)
+		}
+		for _, m := range mfs[family].GetMetric() {
+			// The other global labels are still added.
+			wantEnv := !hasLabel(m, "name", "dropped")
+			if got := hasLabel(m, "env", "prod"); got != wantEnv || !hasLabel(m, "dc", "east") {
+				t.Errorf("got %s, want env label %t and the dc label", seriesString(family, m), wantEnv)
+			}
+		}
+	}
+}
+
+func TestCollisionPrefix(t *testing.T) {
+	var bDown atomic.Bool
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE requests_total counter\nrequests_total 1\n# TYPE a_only gauge\na_only 1\n")
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bDown.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "# TYPE requests_total counter\nrequests_total 2\n")
+	}))
+	defer b.Close()
+	loadTestConfig(t, `groups:
+  - name: a
+    targets:
+      - url: `+a.URL+`
+        collision_prefix: a_
+  - name: b
+    targets:
+      - url: `+b.URL+`
+        collision_prefix: b_
+`)
+	// families returns the names of the metric families served at path,
+	// the exporter's own aside.
+	families := func(path string) []string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleMetrics(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var names []string
+		for n := range parseText(t, rec.Body.String()) {
+			if !strings.HasPrefix(n, "pue_") {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	want := []string{"a_only", "a_requests_total", "b_requests_total"}
+	if got := families("/metrics"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got families %v, want %v", got, want)
+	}
+	// The names don't depend on which targets are part of the scrape, or
+	// whether the others are up.
+	want = []string{"a_only", "a_requests_total"}
+	if got := families("/metrics/a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got families %v of group a, want %v", got, want)
+	}
+	bDown.Store(true)
+	if got := families("/metrics"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got families %v with b down, want %v", got, want)
+	}
+}
+
+func TestEmptyResponseStatus(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE a gauge\na 1\n")
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	tests := []struct {
+		name       string
+		config     string
+		wantStatus int
+	}{
+		{name: "all down by default", config: "targets:\n  - url: " + down.URL + "\n", wantStatus: http.StatusOK},
+		{name: "all down", config: "empty_response_status: 503\ntargets:\n  - url: " + down.URL + "\n", wantStatus: http.StatusServiceUnavailable},
+		{name: "all filtered", config: "empty_response_status: 503\ntargets:\n  - url: " + up.URL + "\n    metric_deny: [a]\n", wantStatus: http.StatusServiceUnavailable},
+		{name: "some metrics", config: "empty_response_status: 503\ntargets:\n  - url: " + up.URL + "\n  - url: " + down.URL + "\n", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, tt.config)
+			rec := httptest.NewRecorder()
+			handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+	if _, err := loadConfig(writeTestConfig(t, "empty_response_status: 99\ntargets:\n  - url: "+up.URL+"\n")); err == nil {
+		t.Error("got no error loading an invalid empty_response_status")
+	}
+}
+
+func TestValidateMetrics(t *testing.T) {
+	gauge := func(v float64, labels ...string) *dto.Metric {
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(v)}}
+		for i := 0; i+1 < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+		}
+		return m
+	}
+	family := func(name string, typ dto.MetricType, metrics ...*dto.Metric) map[string]*dto.MetricFamily {
+		return map[string]*dto.MetricFamily{name: {Name: proto.String(name), Type: typ.Enum(), Metric: metrics}}
+	}
+	tests := []struct {
+		name    string
+		mfs     map[string]*dto.MetricFamily
+		wantErr string
+	}{
+		{name: "valid", mfs: family("a", dto.MetricType_GAUGE, gauge(1, "i", "1"), gauge(2, "i", "2"))},
+		{name: "duplicate series", mfs: family("a", dto.MetricType_GAUGE, gauge(1, "i", "1"), gauge(2, "i", "1")), wantErr: `duplicate series a{i="1"}`},
+		{name: "wrong type", mfs: family("a", dto.MetricType_COUNTER, gauge(1)), wantErr: "a: metric of the wrong type for a COUNTER"},
+		{name: "invalid name", mfs: family("a-b", dto.MetricType_GAUGE, gauge(1)), wantErr: `invalid metric name "a-b"`},
+		{name: "duplicate label", mfs: family("a", dto.MetricType_GAUGE, gauge(1, "i", "1", "i", "2")), wantErr: `a: duplicate label "i"`},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMetrics(tt.mfs)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE a gauge\na 1\n")
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+	// Without labels to tell them apart, the series of the targets collide
+	// when merged.
+	targets := "targets:\n  - url: " + first.URL + "\n  - url: " + second.URL + "\n"
+	tests := []struct {
+		name       string
+		config     string
+		wantStatus int
+	}{
+		{name: "unvalidated", config: targets, wantStatus: http.StatusOK},
+		{name: "validated", config: "validate_output: true\n" + targets, wantStatus: http.StatusInternalServerError},
+		{name: "valid", config: "validate_output: true\ninstance_label: true\n" + targets, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, tt.config)
+			rec := httptest.NewRecorder()
+			handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	const input = `# TYPE a counter
+a{i="1"} 1
+a{i="2"} 2
+# TYPE b gauge
+b{i="1"} 1
+b{i="2"} 2
+b{i="3"} 3
+`
+	tests := []struct {
+		name          string
+		maxSeries     int
+		want          string
+		wantTruncated float64
+	}{
+		{
+			name:      "above",
+			maxSeries: 3,
+			want: `# TYPE a counter
+a{i="1"} 1
+a{i="2"} 2
+# TYPE b gauge
+b{i="1"} 1
+`,
+			wantTruncated: 1,
+		},
+		{
+			name:      "within first family",
+			maxSeries: 1,
+			want: `# TYPE a counter
+a{i="1"} 1
+`,
+			wantTruncated: 1,
+		},
+		{
+			name:      "equal",
+			maxSeries: 5,
+			want:      input,
+		},
+		{
+			name:      "below",
+			maxSeries: 10,
+			want:      input,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, fmt.Sprintf("targets:\n  - url: http://127.0.0.1:9100/metrics\n    max_series: %d\n", tt.maxSeries))
+			target := cfg.Targets[0]
+
+			mfs, err := processMetrics(target, parseText(t, input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formatText(t, mfs); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if got := gaugeValue(t, targetSeriesTruncated.WithLabelValues(target.URL)); got != tt.wantTruncated {
+				t.Errorf("got pue_target_series_truncated %v, want %v", got, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestSampleLimit(t *testing.T) {
+	const input = `# TYPE a gauge
+a{i="1"} 1
+a{i="2"} 2
+# TYPE b histogram
+b_bucket{le="1"} 1
+b_bucket{le="+Inf"} 2
+b_sum 3
+b_count 2
+`
+	tests := []struct {
+		name         string
+		sampleLimit  int
+		wantErr      bool
+		wantExceeded float64
+	}{
+		{
+			name:        "below",
+			sampleLimit: 10,
+		},
+		{
+			name:        "equal",
+			sampleLimit: 6,
+		},
+		{
+			name:         "above",
+			sampleLimit:  5,
+			wantErr:      true,
+			wantExceeded: 1,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, fmt.Sprintf("targets:\n  - url: http://127.0.0.1:9100/metrics\n    sample_limit: %d\n", tt.sampleLimit))
+			target := cfg.Targets[0]
+
+			mfs, err := processMetrics(target, parseText(t, input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			want := input
+			if tt.wantErr {
+				want = ""
+			}
+			if got := formatText(t, mfs); got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+			if got := gaugeValue(t, targetExceededSampleLimit.WithLabelValues(target.URL)); got != tt.wantExceeded {
+				t.Errorf("got pue_target_exceeded_sample_limit %v, want %v", got, tt.wantExceeded)
+			}
+		})
+	}
+}
+
+// flakyTarget is a target failing its first failures fetches, which records
+// when each fetch happened.
+type flakyTarget struct {
+	failures int
+
+	mu       sync.Mutex
+	attempts []time.Time
+}
+
+func (f *flakyTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.attempts = append(f.attempts, time.Now())
+	n := len(f.attempts)
+	f.mu.Unlock()
+	if n <= f.failures {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "up 1")
+}
+
+// waits returns the time between successive fetches.
+func (f *flakyTarget) waits() []time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var waits []time.Duration
+	for i := 1; i < len(f.attempts); i++ {
+		waits = append(waits, f.attempts[i].Sub(f.attempts[i-1]))
+	}
+	return waits
+}
+
+func TestCacheTTL(t *testing.T) {
+	var mu sync.Mutex
+	fetches := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get("X-Tenant")
+		mu.Lock()
+		fetches[tenant]++
+		mu.Unlock()
+		fmt.Fprintf(w, "# TYPE tenant gauge\ntenant{name=%q} 1\n", tenant)
+	}))
+	defer srv.Close()
+	// The targets share their URL, so each must get its own cache entry
+	// rather than one per URL.
+	cfg := loadTestConfig(t, fmt.Sprintf(`targets:
+  - url: %[1]s
+    cache_ttl: 1m
+    headers: {X-Tenant: a}
+    labels: {tenant: a}
+  - url: %[1]s
+    cache_ttl: 1m
+    headers: {X-Tenant: b}
+    labels: {tenant: b}
+  - url: %[1]s
+    headers: {X-Tenant: c}
+    labels: {tenant: c}
+`, srv.URL))
+
+	for i := 0; i < 2; i++ {
+		for _, target := range cfg.Targets {
+			mfs, err := fetchMetricsCached(context.Background(), target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprintf("# TYPE tenant gauge\ntenant{name=%q} 1\n", target.Headers["X-Tenant"])
+			if got := formatText(t, mfs); got != want {
+				t.Errorf("fetch %d of target with headers %v: got\n%s\nwant\n%s", i+1, target.Headers, got, want)
+			}
+		}
+	}
+	want := map[string]int{"a": 1, "b": 1, "c": 2}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(fetches, want) {
+		t.Errorf("got fetches by tenant %v, want %v", fetches, want)
+	}
+}
+
+func TestCacheAge(t *testing.T) {
+	srv := serveMetrics(t)
+	cfg := loadTestConfig(t, "targets:\n  - url: "+srv.URL+"\n    cache_ttl: 1m\n")
+	target := cfg.Targets[0]
+	age := targetCacheAge.WithLabelValues(target.URL, target.key())
+
+	if _, err := fetchMetricsCached(context.Background(), target); err != nil {
+		t.Fatal(err)
+	}
+	if got := gaugeValue(t, age); got != 0 {
+		t.Errorf("got age %v after fetching, want 0", got)
+	}
+	// Make the cached metrics 30s old.
+	fetchCacheMu.Lock()
+	c := fetchCache[target.key()]
+	c.at = c.at.Add(-30 * time.Second)
+	fetchCache[target.key()] = c
+	fetchCacheMu.Unlock()
+	if _, err := fetchMetricsCached(context.Background(), target); err != nil {
+		t.Fatal(err)
+	}
+	if got := gaugeValue(t, age); got < 30 || got > 31 {
+		t.Errorf("got age %v after serving from the cache, want 30", got)
+	}
+}
+
+func TestPreviewLimits(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE a gauge\na{i=\"1\"} 1\na{i=\"2\"} 2\n")
+	}))
+	defer srv.Close()
+	cfg := loadTestConfig(t, fmt.Sprintf(`targets:
+  - url: %[1]s/a
+    sample_limit: 1
+  - url: %[1]s/b
+    max_series: 1
+`, srv.URL))
+
+	for _, target := range cfg.Targets {
+		rec := httptest.NewRecorder()
+		handlePreview(rec, httptest.NewRequest(http.MethodGet, "/debug/preview?target="+url.QueryEscape(target.URL), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+		}
+	}
+	// Previewing isn't scraping, so the limits hit aren't reported.
+	if got := gaugeValue(t, targetExceededSampleLimit.WithLabelValues(srv.URL+"/a")); got != 0 {
+		t.Errorf("got pue_target_exceeded_sample_limit %v, want 0", got)
+	}
+	if got := gaugeValue(t, targetSeriesTruncated.WithLabelValues(srv.URL+"/b")); got != 0 {
+		t.Errorf("got pue_target_series_truncated %v, want 0", got)
+	}
+}
+
+func TestDebugOutputLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fleetBody(100))
+	}))
+	defer srv.Close()
+	tests := []struct {
+		name          string
+		limit         int
+		wantTruncated bool
+	}{
+		{name: "under", limit: 1 << 20},
+		{name: "over", limit: 500, wantTruncated: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, fmt.Sprintf("debug_endpoints: true\ndebug_output_limit: %d\ntargets:\n  - url: %s\n", tt.limit, srv.URL))
+			rec := httptest.NewRecorder()
+			newMux(cfg, "").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/preview?target="+url.QueryEscape(srv.URL), nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+			}
+			body := rec.Body.String()
+			notice := fmt.Sprintf("\n... output truncated at %d bytes, see debug_output_limit\n", tt.limit)
+			if got := strings.HasSuffix(body, notice); got != tt.wantTruncated {
+				t.Fatalf("got truncated %t, want %t", got, tt.wantTruncated)
+			}
+			if tt.wantTruncated && len(body) != tt.limit+len(notice) {
+				t.Errorf("got %d bytes, want %d up to the limit and the notice", len(body), tt.limit+len(notice))
+			}
+		})
+	}
+}
+
+func TestWriteGraphite(t *testing.T) {
+	mfs := parseText(t, `# TYPE requests_total counter
+requests_total{code="200",path="/a b"} 3
+# TYPE temp gauge
+temp 21.5 1600000000500
+# TYPE latency histogram
+latency_bucket{le="0.5"} 1
+latency_bucket{le="1"} 2
+latency_sum 1.25
+latency_count 3
+`)
+	ts := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		config GraphiteConfig
+		want   string
+	}{
+		{
+			name: "dotted",
+			want: `latency_bucket.le.0_5 1 1700000000
+latency_bucket.le.1 2 1700000000
+latency_bucket.le.+Inf 3 1700000000
+latency_sum 1.25 1700000000
+latency_count 3 1700000000
+requests_total.code.200.path._a_b 3 1700000000
+temp 21.5 1600000000
+`,
+		},
+		{
+			name:   "tagged",
+			config: GraphiteConfig{Naming: "tagged", Prefix: "pue."},
+			want: `pue.latency_bucket;le=0.5 1 1700000000
+pue.latency_bucket;le=1 2 1700000000
+pue.latency_bucket;le=+Inf 3 1700000000
+pue.latency_sum 1.25 1700000000
+pue.latency_count 3 1700000000
+pue.requests_total;code=200;path=/a b 3 1700000000
+pue.temp 21.5 1600000000
+`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := writeGraphite(&b, mfs, &tt.config, ts); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGraphiteEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE a gauge\na 1\n")
+	}))
+	defer srv.Close()
+	target := "targets:\n  - url: " + srv.URL + "\n"
+	tests := []struct {
+		name       string
+		config     string
+		path       string
+		wantStatus int
+	}{
+		{name: "disabled", config: target, path: "/graphite", wantStatus: http.StatusNotFound},
+		{name: "default path", config: "graphite: {}\n" + target, path: "/graphite", wantStatus: http.StatusOK},
+		{name: "custom path", config: "graphite: {path: /g}\n" + target, path: "/g", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, tt.config)
+			rec := httptest.NewRecorder()
+			newMux(cfg, "").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && !regexp.MustCompile(`(?m)^a \d+ \d+$`).MatchString(rec.Body.String()) {
+				t.Errorf("got\n%s\nwant a line of a", rec.Body)
+			}
+		})
+	}
+}
+
+func TestReadyCheckTargets(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE a gauge\na 1\n")
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	targets := "targets:\n  - url: " + up.URL + "\n  - url: " + down.URL + "\n  - url: " + hung.URL + "\n"
+	tests := []struct {
+		name       string
+		path       string
+		minTargets int
+		wantStatus int
+	}{
+		{name: "unchecked", path: "/-/ready", minTargets: 3, wantStatus: http.StatusOK},
+		{name: "quorum", path: "/-/ready?check=targets", minTargets: 1, wantStatus: http.StatusOK},
+		{name: "no quorum", path: "/-/ready?check=targets", minTargets: 2, wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, fmt.Sprintf("ready_min_targets: %d\nready_probe_timeout: 100ms\n%s", tt.minTargets, targets))
+			start := time.Now()
+			rec := httptest.NewRecorder()
+			handleReady(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			// The hung target is given up on after the probe timeout.
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("took %s, want the probes bounded by ready_probe_timeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestFamilyOrders(t *testing.T) {
+	const input = `# HELP b_total Bytes.
+# TYPE b_total counter
+b_total 1
+# HELP c Connections.
+# TYPE c gauge
+c 1
+# HELP a Active.
+# TYPE a gauge
+a 1
+# HELP d_total All requests.
+# TYPE d_total counter
+d_total 1
+`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, input)
+	}))
+	defer srv.Close()
+	loadTestConfig(t, "debug_endpoints: true\ntargets:\n  - url: "+srv.URL+"\n")
+	// families returns the names of the families in text in order.
+	families := func(text string) []string {
+		var names []string
+		for _, line := range strings.Split(text, "\n") {
+			if name, ok := strings.CutPrefix(line, "# TYPE "); ok {
+				names = append(names, strings.Fields(name)[0])
+			}
+		}
+		return names
+	}
+	tests := []struct {
+		sort string
+		want []string
+	}{
+		{sort: "", want: []string{"a", "b_total", "c", "d_total"}},
+		{sort: "name", want: []string{"a", "b_total", "c", "d_total"}},
+		{sort: "type", want: []string{"b_total", "d_total", "a", "c"}},
+		{sort: "help", want: []string{"a", "d_total", "b_total", "c"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.sort, func(t *testing.T) {
+			var b bytes.Buffer
+			order := byName
+			if tt.sort != "" {
+				order = familyOrders[tt.sort]
+			}
+			if err := serializeMetrics(&b, expfmt.FmtText, order, parseText(t, input)); err != nil {
+				t.Fatal(err)
+			}
+			if got := families(b.String()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got families %v, want %v", got, tt.want)
+			}
+
+			rec := httptest.NewRecorder()
+			handlePreview(rec, httptest.NewRequest(http.MethodGet, "/debug/preview?sort="+tt.sort+"&target="+url.QueryEscape(srv.URL), nil))
+			// The preview shows the metrics before and after transformation.
+			want := append(append([]string(nil), tt.want...), tt.want...)
+			if got := families(rec.Body.String()); !reflect.DeepEqual(got, want) {
+				t.Errorf("got families %v from the preview, want %v", got, want)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	handlePreview(rec, httptest.NewRequest(http.MethodGet, "/debug/preview?sort=size&target="+url.QueryEscape(srv.URL), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an unknown sort order, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestReloadEndpoints(t *testing.T) {
+	const config = "targets:\n  - url: http://127.0.0.1:9100/metrics\n"
+	path := writeTestConfig(t, config)
+	cfg := loadTestConfig(t, config)
+	oldMux := activeMux.Swap(newMux(cfg, path))
+	t.Cleanup(func() { activeMux.Store(oldMux) })
+	get := func() int {
+		rec := httptest.NewRecorder()
+		serveActiveMux(rec, httptest.NewRequest(http.MethodGet, "/telemetry", nil))
+		return rec.Code
+	}
+
+	if got := get(); got != http.StatusNotFound {
+		t.Errorf("got status %d before enabling telemetry_path, want %d", got, http.StatusNotFound)
+	}
+	if err := os.WriteFile(path, []byte(config+"telemetry_path: /telemetry\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(); got != http.StatusOK {
+		t.Errorf("got status %d after enabling telemetry_path, want %d", got, http.StatusOK)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var mu sync.Mutex
+	fetches := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get("X-Tenant")
+		mu.Lock()
+		fetches[tenant]++
+		mu.Unlock()
+		if tenant == "down" {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer srv.Close()
+	// The targets share their URL, so each must get its own breaker rather
+	// than one per URL.
+	cfg := loadTestConfig(t, fmt.Sprintf(`targets:
+  - url: %[1]s
+    breaker_threshold: 1
+    headers: {X-Tenant: down}
+    labels: {tenant: down}
+  - url: %[1]s
+    breaker_threshold: 1
+    headers: {X-Tenant: up}
+    labels: {tenant: up}
+`, srv.URL))
+
+	for i := 0; i < 3; i++ {
+		for _, target := range cfg.Targets {
+			if breakerAllows(target) {
+				_, err := fetchMetrics(context.Background(), target)
+				recordBreaker(target, err)
+			}
+		}
+	}
+	want := map[string]int{"down": 1, "up": 3}
+	mu.Lock()
+	if !reflect.DeepEqual(fetches, want) {
+		t.Errorf("got fetches by tenant %v, want %v", fetches, want)
+	}
+	mu.Unlock()
+	for i, wantOpen := range []float64{1, 0} {
+		target := cfg.Targets[i]
+		if got := gaugeValue(t, targetBreakerOpen.WithLabelValues(target.URL, target.key())); got != wantOpen {
+			t.Errorf("got pue_target_breaker_open %v for target with labels %v, want %v", got, target.Labels, wantOpen)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		retries      int
+		timeout      time.Duration
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "no retries", failures: 1, wantAttempts: 1, wantErr: true},
+		{name: "succeeds on retry", failures: 2, retries: 3, wantAttempts: 3},
+		{name: "gives up", failures: 5, retries: 2, wantAttempts: 3, wantErr: true},
+		{name: "deadline too close", failures: 5, retries: 3, timeout: 50 * time.Millisecond, wantAttempts: 2, wantErr: true},
+	}
+	const backoff = 20 * time.Millisecond
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			target := &flakyTarget{failures: tt.failures}
+			srv := httptest.NewServer(target)
+			defer srv.Close()
+			cfg := loadTestConfig(t, fmt.Sprintf("targets:\n  - url: %s\n    retries: %d\n    retry_backoff: %s\n", srv.URL, tt.retries, backoff))
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			_, err := fetchMetrics(ctx, cfg.Targets[0])
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			waits := target.waits()
+			if len(waits)+1 != tt.wantAttempts {
+				t.Fatalf("got %d attempts, want %d", len(waits)+1, tt.wantAttempts)
+			}
+			// Without jitter, the backoff doubles after each retry.
+			for i, wait := range waits {
+				if want := backoff << i; wait < want {
+					t.Errorf("retry #%d after %s, want at least %s", i+1, wait, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	const (
+		targets = 5
+		backoff = 200 * time.Millisecond
+	)
+	tests := []struct {
+		jitter bool
+	}{
+		{jitter: false},
+		{jitter: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(fmt.Sprintf("jitter=%v", tt.jitter), func(t *testing.T) {
+			var config strings.Builder
+			config.WriteString("targets:\n")
+			var flaky []*flakyTarget
+			for i := 0; i < targets; i++ {
+				target := &flakyTarget{failures: 1}
+				srv := httptest.NewServer(target)
+				defer srv.Close()
+				flaky = append(flaky, target)
+				fmt.Fprintf(&config, "  - url: %s\n    retries: 1\n    retry_backoff: %s\n    retry_jitter: %v\n", srv.URL, backoff, tt.jitter)
+			}
+			cfg := loadTestConfig(t, config.String())
+
+			// All targets fail at once, as during a shared outage.
+			var wg sync.WaitGroup
+			for _, target := range cfg.Targets {
+				wg.Add(1)
+				go func(target Target) {
+					defer wg.Done()
+					if _, err := fetchMetrics(context.Background(), target); err != nil {
+						t.Error(err)
+					}
+				}(target)
+			}
+			wg.Wait()
+
+			min, max := time.Duration(math.MaxInt64), time.Duration(0)
+			for _, target := range flaky {
+				wait := target.waits()[0]
+				if wait < min {
+					min = wait
+				}
+				if wait > max {
+					max = wait
+				}
+			}
+			if !tt.jitter && min < backoff {
+				t.Errorf("retried after %s, want at least %s", min, backoff)
+			}
+			// With jitter, waits are spread over [0, backoff], so they
+			// can't all be within a few milliseconds of each other but by
+			// a tiny chance.
+			if tt.jitter && max-min < 10*time.Millisecond {
+				t.Errorf("retries within %s of each other, want them spread out", max-min)
+			}
+		})
+	}
+}
+
+func TestListen(t *testing.T) {
+	const target = "targets:\n  - url: http://127.0.0.1:9100/metrics\n"
+	tests := []struct {
+		name    string
+		config  string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{name: "unset", config: target, want: defaultListen},
+		{name: "unset with env default", config: target, env: "127.0.0.1:9999", want: "127.0.0.1:9999"},
+		{name: "set", config: "listen: 127.0.0.1:9002\n" + target, env: "127.0.0.1:9999", want: "127.0.0.1:9002"},
+		{name: "empty", config: "listen: \"\"\n" + target, wantErr: true},
+		{name: "null", config: "listen:\n" + target, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PUE_DEFAULT_LISTEN", tt.env)
+
+			cfg, err := loadConfig(writeTestConfig(t, tt.config))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got listen %q, want an error", cfg.Listen)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Listen != tt.want {
+				t.Errorf("got listen %q, want %q", cfg.Listen, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetConditions(t *testing.T) {
+	const config = `targets:
+  - url: http://127.0.0.1:9100/always
+  - url: http://127.0.0.1:9100/debug
+    if: PUE_DEBUG
+  - url: http://127.0.0.1:9100/prod
+    if: PUE_ENV=prod
+  - url: http://127.0.0.1:9100/nondebug
+    unless: PUE_DEBUG
+`
+	tests := []struct {
+		name  string
+		debug string
+		env   string
+		want  []string
+	}{
+		{name: "unset", want: []string{"always", "nondebug"}},
+		{name: "debug", debug: "1", want: []string{"always", "debug"}},
+		{name: "prod", env: "prod", want: []string{"always", "prod", "nondebug"}},
+		{name: "other env", env: "staging", want: []string{"always", "nondebug"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PUE_DEBUG", tt.debug)
+			t.Setenv("PUE_ENV", tt.env)
+
+			cfg := loadTestConfig(t, config)
+			var got []string
+			for _, target := range cfg.Targets {
+				got = append(got, path.Base(target.URL))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got targets %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	const config = "targets:\n  - url: http://127.0.0.1:9100/metrics\n    labels: {job: node, env: prod}\n"
+	path := writeTestConfig(t, config)
+	loadTestConfig(t, config)
+	oldMux := activeMux.Load()
+	t.Cleanup(func() { activeMux.Store(oldMux) })
+	// reload reloads config and returns the config hash exposed after.
+	reload := func(config string) string {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := reloadConfig(path); err != nil {
+			t.Fatal(err)
+		}
+		ch := make(chan prometheus.Metric, 2)
+		configHash.Collect(ch)
+		close(ch)
+		var hashes []string
+		for m := range ch {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatal(err)
+			}
+			hashes = append(hashes, pb.Label[0].GetValue())
+		}
+		if len(hashes) != 1 {
+			t.Fatalf("got config hashes %v, want one", hashes)
+		}
+		return hashes[0]
+	}
+
+	hash := reload(config)
+	// The hash is of the effective config, not of its text.
+	if got := reload("# Node exporter.\ntargets:\n- url: http://127.0.0.1:9100/metrics\n  labels:\n    env: prod\n    job: node\n"); got != hash {
+		t.Errorf("got hash %s after reformatting the config, want %s", got, hash)
+	}
+	if got := reload("listen: " + defaultListen + "\n" + config); got != hash {
+		t.Errorf("got hash %s after spelling out a default, want %s", got, hash)
+	}
+	changed := reload(strings.Replace(config, "prod", "dev", 1))
+	if changed == hash {
+		t.Errorf("got the same hash %s after changing a label", hash)
+	}
+	if got := reload(config); got != hash {
+		t.Errorf("got hash %s after reverting the change, want %s", got, hash)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	const target = "targets:\n  - url: http://127.0.0.1:9100/metrics\n"
+	tests := []struct {
+		name    string
+		config  string
+		include string
+		wantErr bool
+	}{
+		{name: "valid", config: target + "    labels:\n      job: node\n    timeout: 5s\n"},
+		{name: "misspelled field", config: "targts: []\n", wantErr: true},
+		{name: "misspelled target field", config: target + "    lables:\n      job: node\n", wantErr: true},
+		{name: "misspelled nested target field", config: target + "    tls_config:\n      server_nam: node\n", wantErr: true},
+		{name: "misspelled scoped label field", config: target + "    labels:\n      job:\n        value: node\n        applies_too: up\n", wantErr: true},
+		{name: "valid include", config: "include: [targets.yml]\n", include: target},
+		{name: "misspelled target field in include", config: "include: [targets.yml]\n", include: target + "    timout: 5s\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestConfig(t, tt.config)
+			if tt.include != "" {
+				if err := os.WriteFile(filepath.Join(filepath.Dir(path), "targets.yml"), []byte(tt.include), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := checkConfig(path); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// fleetBody returns the body served by each target of a synthetic fleet,
+// with series series.
+func fleetBody(series int) []byte {
+	var body bytes.Buffer
+	body.WriteString("# TYPE http_requests_total counter\n")
+	for i := 0; i < series; i++ {
+		fmt.Fprintf(&body, "http_requests_total{code=\"200\",handler=\"/api/v1/items/%d\",method=\"GET\"} %d\n", i, i*7)
+	}
+	return body.Bytes()
+}
+
+// fleetConfig returns a config of n targets served by srv, with extra
+// appended.
+func fleetConfig(srv *httptest.Server, n int, extra string) string {
+	var b strings.Builder
+	b.WriteString(extra + "targets:\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "  - url: %s/%d\n", srv.URL, i)
+	}
+	return b.String()
+}
+
+func TestFetchMemoryBudget(t *testing.T) {
+	body := fleetBody(1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+	budget := 2 * len(body)
+	cfg := loadTestConfig(t, fleetConfig(srv, 20, fmt.Sprintf("fetch_memory_budget: %d\n", budget)))
+
+	for _, res := range scrapeGroup(context.Background(), cfg, "") {
+		if res.err != nil {
+			t.Errorf("target %s: %v", res.target.URL, res.err)
+		}
+	}
+	// Only the oldest fetch may go over the budget, by at most its body and
+	// a read.
+	if peak, max := cfg.fetchBudget.peak, int64(budget+len(body)+cfg.ReadBufferSize); peak > max {
+		t.Errorf("got peak of %d bytes, want at most %d", peak, max)
+	}
+	if cfg.fetchBudget.used != 0 {
+		t.Errorf("got %d bytes still used after scraping, want 0", cfg.fetchBudget.used)
+	}
+}
+
+// BenchmarkFetchMemoryBudget scrapes a large synthetic fleet with memory
+// budgets of different sizes, reporting the peak bytes of responses being
+// read at once.
+func BenchmarkFetchMemoryBudget(b *testing.B) {
+	body := fleetBody(2000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+	// A budget too large to ever be reached measures the bytes in flight
+	// without one.
+	for _, budget := range []int64{1 << 62, 16 << 20, 4 << 20, 1 << 20} {
+		budget := budget
+		name := fmt.Sprintf("%dMiB", budget>>20)
+		if budget == 1<<62 {
+			name = "unlimited"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg := loadTestConfig(b, fleetConfig(srv, 200, fmt.Sprintf("fetch_memory_budget: %d\n", budget)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				scrapeGroup(context.Background(), cfg, "")
+			}
+			b.ReportMetric(float64(cfg.fetchBudget.peak), "peak-inflight-B")
+		})
+	}
+}
+
+func BenchmarkReadBufferSize(b *testing.B) {
+	var body bytes.Buffer
+	body.WriteString("# TYPE http_requests_total counter\n")
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&body, "http_requests_total{code=\"200\",handler=\"/api/v1/items/%d\",method=\"GET\"} %d\n", i, i*7)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body.Bytes())
+	}))
+	defer srv.Close()
+	for _, size := range []int{4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		size := size
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			cfg := loadTestConfig(b, fmt.Sprintf("read_buffer_size: %d\ntargets:\n  - url: %s\n", size, srv.URL))
+			b.SetBytes(int64(body.Len()))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := fetchMetricsOnce(context.Background(), cfg.Targets[0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// scrapeOnce scrapes all targets once and writes the merged metrics in the
+// text format to the file at path, or to stdout if path is empty. The file
+// is replaced atomically, so that it can be read e.g. by the textfile
+// collector of node_exporter while being written.
+func scrapeOnce(path string) error {
+	cfg := currentConfig()
+	// Discovered targets would otherwise only be known once the
+	// discoverers, started in the background, got to refresh.
+	for _, d := range cfg.discoverers {
+		if err := d.refresh(); err != nil {
+			warnf("failed to refresh targets from %s: %v", d.source(), err)
+		}
+	}
+	start := time.Now()
+	metricFamilies, _ := collateMetrics(context.Background(), "")
+	if cfg.TimestampSamples {
+		setTimestamps(metricFamilies, start)
+	}
+	if path == "" {
+		return writeText(os.Stdout, metricFamilies)
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := writeText(f, metricFamilies); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeText writes the metric families to w in the text format.
+func writeText(w io.Writer, metricFamilies map[string]*dto.MetricFamily) error {
+	bw := bufio.NewWriter(w)
+	if err := serializeMetrics(bw, expfmt.FmtText, byName, metricFamilies); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
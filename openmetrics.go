@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// responseFormat returns the format of a response from its Content-Type,
+// which unlike expfmt.ResponseFormat includes OpenMetrics.
+func responseFormat(h http.Header) expfmt.Format {
+	if mediatype, _, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil && mediatype == expfmt.OpenMetricsType {
+		return expfmt.FmtOpenMetrics
+	}
+	return expfmt.ResponseFormat(h)
+}
+
+// errMissingEOF is returned when OpenMetrics input ends without # EOF, which
+// means it was cut short.
+var errMissingEOF = errors.New("openmetrics: missing # EOF")
+
+// openMetricsReader converts OpenMetrics text read from r into the
+// Prometheus text format on the fly, for the text parser to read:
+//
+//   - counter families are named after their _total samples, and info
+//     families after their _info samples, as gauges
+//   - gauge histograms become histograms and state sets gauges
+//   - _created samples, units and exemplars are dropped
+//   - timestamps are converted from seconds to milliseconds
+//
+// Reading fails with errMissingEOF if the input ends without # EOF, and with
+// an error if anything follows it.
+type openMetricsReader struct {
+	r *bufio.Reader
+	// out holds converted text not yet read.
+	out bytes.Buffer
+	err error
+	eof bool
+	// name and typ are those of the family being read. Its HELP is held
+	// back until its TYPE is known, as it may come first.
+	name, typ, help  string
+	hasHelp, written bool
+}
+
+func newOpenMetricsReader(r io.Reader) *openMetricsReader {
+	return &openMetricsReader{r: bufio.NewReader(r)}
+}
+
+func (r *openMetricsReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 && r.err == nil {
+		r.err = r.convertLine()
+	}
+	if r.out.Len() > 0 {
+		return r.out.Read(p)
+	}
+	return 0, r.err
+}
+
+// convertLine converts the next line of input into out.
+func (r *openMetricsReader) convertLine() error {
+	line, err := r.r.ReadString('\n')
+	if err == io.EOF {
+		if line != "" {
+			// The last line, which must be # EOF, has no newline.
+			err = nil
+		} else if !r.eof {
+			return errMissingEOF
+		}
+	}
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	switch {
+	case r.eof:
+		return fmt.Errorf("openmetrics: unexpected %q after # EOF", line)
+	case line == "# EOF":
+		r.eof = true
+		r.writeMetadata()
+		return nil
+	case strings.HasPrefix(line, "# "):
+		return r.metadata(line)
+	case line == "":
+		return errors.New("openmetrics: unexpected blank line")
+	}
+	r.writeMetadata()
+	return r.sample(line)
+}
+
+// metadata records the HELP, TYPE or UNIT line of a family.
+func (r *openMetricsReader) metadata(line string) error {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 {
+		return fmt.Errorf("openmetrics: invalid line %q", line)
+	}
+	if name := fields[2]; name != r.name || r.written {
+		r.writeMetadata()
+		r.name, r.typ, r.help, r.hasHelp, r.written = name, "", "", false, false
+	}
+	text := ""
+	if len(fields) == 4 {
+		text = fields[3]
+	}
+	switch fields[1] {
+	case "HELP":
+		// Unlike in the text format, quotes are escaped.
+		r.help, r.hasHelp = strings.ReplaceAll(text, `\"`, `"`), true
+	case "TYPE":
+		r.typ = text
+	case "UNIT":
+	default:
+		return fmt.Errorf("openmetrics: invalid line %q", line)
+	}
+	return nil
+}
+
+// writeMetadata writes the HELP and TYPE lines of the family being read, if
+// not already written.
+func (r *openMetricsReader) writeMetadata() {
+	if r.written || r.name == "" {
+		return
+	}
+	r.written = true
+	name, typ := r.name, r.typ
+	switch typ {
+	case "counter":
+		name += "_total"
+	case "info":
+		name += "_info"
+		typ = "gauge"
+	case "stateset":
+		typ = "gauge"
+	case "gaugehistogram":
+		typ = "histogram"
+	case "unknown":
+		typ = "untyped"
+	}
+	if r.hasHelp {
+		fmt.Fprintf(&r.out, "# HELP %s %s\n", name, r.help)
+	}
+	if typ != "" {
+		fmt.Fprintf(&r.out, "# TYPE %s %s\n", name, typ)
+	}
+}
+
+// sample converts a sample line into out.
+func (r *openMetricsReader) sample(line string) error {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return fmt.Errorf("openmetrics: invalid line %q", line)
+	}
+	name := line[:end]
+	if strings.HasPrefix(name, r.name) {
+		switch suffix := name[len(r.name):]; {
+		case suffix == "_created" && (r.typ == "counter" || r.typ == "histogram" || r.typ == "summary" || r.typ == "gaugehistogram"):
+			return nil
+		case r.typ == "gaugehistogram" && suffix == "_gcount":
+			name = r.name + "_count"
+		case r.typ == "gaugehistogram" && suffix == "_gsum":
+			name = r.name + "_sum"
+		}
+	}
+	rest := line[end:]
+	labels := ""
+	if rest[0] == '{' {
+		n, err := labelsEnd(rest)
+		if err != nil {
+			return fmt.Errorf("openmetrics: %w in %q", err, line)
+		}
+		labels, rest = rest[:n], rest[n:]
+	}
+	// Exemplars follow the value and timestamp after a #.
+	if i := strings.Index(rest, " # "); i >= 0 {
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	switch len(fields) {
+	case 1:
+		fmt.Fprintf(&r.out, "%s%s %s\n", name, labels, fields[0])
+	case 2:
+		ts, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("openmetrics: invalid timestamp in %q", line)
+		}
+		fmt.Fprintf(&r.out, "%s%s %s %d\n", name, labels, fields[0], int64(math.Round(ts*1000)))
+	default:
+		return fmt.Errorf("openmetrics: invalid line %q", line)
+	}
+	return nil
+}
+
+// labelsEnd returns the length of the label set s starts with, skipping over
+// quoted label values which may contain braces.
+func labelsEnd(s string) (int, error) {
+	quoted := false
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == '}':
+			return i + 1, nil
+		}
+	}
+	return 0, errors.New("unterminated label set")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// perTargetMetrics is the exporter's own metrics with a series per target,
+// by its URL as the instance label.
+var perTargetMetrics = []*prometheus.MetricVec{
+	scrapeBytesTotal.MetricVec,
+	targetSeriesTruncated.MetricVec,
+	targetExceededSampleLimit.MetricVec,
+	targetSampled.MetricVec,
+	targetCertExpiry.MetricVec,
+	targetStale.MetricVec,
+	targetFetchErrorsTotal.MetricVec,
+	targetParseErrorsTotal.MetricVec,
+	relabelTypeMismatchesTotal.MetricVec,
+}
+
+// pruneTargets forgets what is kept by URL or key about targets which are
+// no longer active in the config in effect, i.e. their series of the
+// exporter's own metrics, cached metrics, circuit breaker and exposed metric
+// families, so that they don't pile up as targets come and go. It's called
+// on reload and after each refresh of service discovery.
+func pruneTargets() {
+	cfg := currentConfig()
+	if cfg == nil {
+		return
+	}
+	active := map[string]bool{}
+	activeKeys := map[string]bool{}
+	for _, t := range activeTargets(cfg) {
+		active[t.URL] = true
+		activeKeys[t.key()] = true
+	}
+	for _, v := range perTargetMetrics {
+		for _, u := range instances(v) {
+			if !active[u] {
+				v.DeleteLabelValues(u)
+			}
+		}
+	}
+	fetchCacheMu.Lock()
+	for k := range fetchCache {
+		if !activeKeys[k] {
+			delete(fetchCache, k)
+			targetCacheAge.DeletePartialMatch(prometheus.Labels{"target": k})
+		}
+	}
+	fetchCacheMu.Unlock()
+	breakersMu.Lock()
+	for k := range breakers {
+		if !activeKeys[k] {
+			delete(breakers, k)
+			targetBreakerOpen.DeletePartialMatch(prometheus.Labels{"target": k})
+		}
+	}
+	breakersMu.Unlock()
+	pruneCollisions(active)
+}
+
+// instances returns the values of the instance label of the series of v.
+func instances(v *prometheus.MetricVec) []string {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		v.Collect(ch)
+		close(ch)
+	}()
+	var urls []string
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+		for _, lp := range pb.Label {
+			if lp.GetName() == "instance" {
+				urls = append(urls, lp.GetValue())
+			}
+		}
+	}
+	return urls
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// RelabelConfig is a Prometheus style relabeling rule, applied to the labels
+// of a target before it's scraped. Along with the labels of the target, the
+// rules see its URL as the __scheme__, __address__ and __metrics_path__
+// labels, which can be rewritten too.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	// Separator joins the values of the source labels, ; by default.
+	Separator string `yaml:"separator"`
+	// Regex is matched against the joined values, or label names for the
+	// labelmap, labeldrop and labelkeep actions. It defaults to (.*).
+	Regex       string `yaml:"regex"`
+	TargetLabel string `yaml:"target_label"`
+	// Replacement is expanded with the groups of Regex, $1 by default.
+	Replacement string `yaml:"replacement"`
+	Modulus     uint64 `yaml:"modulus"`
+	// Action is one of replace (default), keep, drop, hashmod, labelmap,
+	// labeldrop and labelkeep.
+	Action string `yaml:"action"`
+}
+
+// relabelRule is the compiled form of RelabelConfig.
+type relabelRule struct {
+	RelabelConfig
+	regex *regexp.Regexp
+}
+
+// compileRelabelConfigs validates the rules and applies their defaults.
+func compileRelabelConfigs(configs []RelabelConfig) ([]relabelRule, error) {
+	rules := make([]relabelRule, 0, len(configs))
+	for i, c := range configs {
+		if c.Separator == "" {
+			c.Separator = ";"
+		}
+		if c.Regex == "" {
+			c.Regex = "(.*)"
+		}
+		if c.Replacement == "" {
+			c.Replacement = "$1"
+		}
+		if c.Action == "" {
+			c.Action = "replace"
+		}
+		re, err := regexp.Compile("^(?:" + c.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d: %w", i+1, err)
+		}
+		switch c.Action {
+		case "replace":
+			if c.TargetLabel == "" {
+				return nil, fmt.Errorf("rule #%d: target_label must be set for %s", i+1, c.Action)
+			}
+		case "hashmod":
+			if c.TargetLabel == "" || c.Modulus == 0 {
+				return nil, fmt.Errorf("rule #%d: target_label and modulus must be set for %s", i+1, c.Action)
+			}
+		case "keep", "drop", "labelmap", "labeldrop", "labelkeep":
+		default:
+			return nil, fmt.Errorf("rule #%d: unknown action %q", i+1, c.Action)
+		}
+		rules = append(rules, relabelRule{c, re})
+	}
+	return rules, nil
+}
+
+// relabel applies the rules to the labels, in order. It returns false if the
+// labels are dropped by a keep or drop rule.
+func relabel(labels map[string]string, rules []relabelRule) bool {
+	for _, r := range rules {
+		values := make([]string, len(r.SourceLabels))
+		for i, name := range r.SourceLabels {
+			values[i] = labels[name]
+		}
+		value := strings.Join(values, r.Separator)
+		switch r.Action {
+		case "replace":
+			m := r.regex.FindStringSubmatchIndex(value)
+			if m == nil {
+				continue
+			}
+			target := string(r.regex.ExpandString(nil, r.TargetLabel, value, m))
+			v := string(r.regex.ExpandString(nil, r.Replacement, value, m))
+			if v == "" {
+				delete(labels, target)
+			} else {
+				labels[target] = v
+			}
+		case "keep":
+			if !r.regex.MatchString(value) {
+				return false
+			}
+		case "drop":
+			if r.regex.MatchString(value) {
+				return false
+			}
+		case "hashmod":
+			sum := md5.Sum([]byte(value))
+			labels[r.TargetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % r.Modulus)
+		case "labelmap":
+			mapped := map[string]string{}
+			for name, v := range labels {
+				if m := r.regex.FindStringSubmatchIndex(name); m != nil {
+					mapped[string(r.regex.ExpandString(nil, r.Replacement, name, m))] = v
+				}
+			}
+			for name, v := range mapped {
+				labels[name] = v
+			}
+		case "labeldrop", "labelkeep":
+			for name := range labels {
+				if r.regex.MatchString(name) == (r.Action == "labeldrop") {
+					delete(labels, name)
+				}
+			}
+		}
+	}
+	return true
+}
+
+// relabelTarget applies the relabel_configs of target t to its labels and
+// URL. It returns false if the target is dropped.
+func relabelTarget(t *Target) (bool, error) {
+	rules, err := compileRelabelConfigs(t.RelabelConfigs)
+	if err != nil {
+		return false, err
+	}
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return false, err
+	}
+	labels := make(map[string]string, len(t.Labels)+3)
+	for k, v := range t.Labels {
+		labels[k] = v
+	}
+	labels["__scheme__"] = u.Scheme
+	labels["__address__"] = u.Host
+	labels["__metrics_path__"] = u.Path
+	if !relabel(labels, rules) {
+		return false, nil
+	}
+	u.Scheme, u.Host, u.Path = labels["__scheme__"], labels["__address__"], labels["__metrics_path__"]
+	u.RawPath = ""
+	t.URL = u.String()
+	// Labels starting with __ are reserved for internal use and are not
+	// injected into the metrics.
+	for k := range labels {
+		if strings.HasPrefix(k, "__") {
+			delete(labels, k)
+		}
+	}
+	t.Labels = labels
+	return true, nil
+}
+
+// relabelMetrics applies the rules to the labels of each series, seeing the
+// name of its family as the __name__ label. Series dropped by the rules are
+// removed, and series whose __name__ is rewritten are moved to the family of
+// that name, unless it has a different type, in which case they are dropped
+// as well. The number of series dropped that way is returned.
+func relabelMetrics(metricFamilies map[string]*dto.MetricFamily, rules []relabelRule) int {
+	type move struct {
+		from *dto.MetricFamily
+		name string
+		m    *dto.Metric
+	}
+	var moves []move
+	for n, mf := range metricFamilies {
+		kept := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			labels := make(map[string]string, len(m.Label)+1)
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			labels["__name__"] = n
+			if !relabel(labels, rules) {
+				continue
+			}
+			name := labels["__name__"]
+			delete(labels, "__name__")
+			m.Label = labelPairs(labels)
+			if name != n && name != "" {
+				moves = append(moves, move{mf, name, m})
+				continue
+			}
+			kept = append(kept, m)
+		}
+		mf.Metric = kept
+	}
+	mismatched := 0
+	for _, mv := range moves {
+		mf, ok := metricFamilies[mv.name]
+		if !ok {
+			name := mv.name
+			mf = &dto.MetricFamily{Name: &name, Help: mv.from.Help, Type: mv.from.Type}
+			metricFamilies[name] = mf
+		} else if mf.GetType() != mv.from.GetType() {
+			mismatched++
+			continue
+		}
+		mf.Metric = append(mf.Metric, mv.m)
+	}
+	for n, mf := range metricFamilies {
+		if len(mf.Metric) == 0 {
+			delete(metricFamilies, n)
+		}
+	}
+	return mismatched
+}
+
+// labelPairs returns the labels as label pairs sorted by name.
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for k, v := range labels {
+		k, v := k, v
+		pairs = append(pairs, &dto.LabelPair{Name: &k, Value: &v})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].GetName() < pairs[j].GetName()
+	})
+	return pairs
+}
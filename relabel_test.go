@@ -0,0 +1,269 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestRelabelTarget(t *testing.T) {
+	tests := []struct {
+		name       string
+		labels     map[string]string
+		rules      []RelabelConfig
+		wantKeep   bool
+		wantURL    string
+		wantLabels map[string]string
+		wantErr    bool
+	}{
+		{
+			name:   "replace",
+			labels: map[string]string{"env": "prod"},
+			rules: []RelabelConfig{
+				{SourceLabels: []string{"env"}, TargetLabel: "environment"},
+				{SourceLabels: []string{"env"}, Regex: "prod", TargetLabel: "env", Replacement: "production"},
+			},
+			wantKeep:   true,
+			wantURL:    "http://10.0.0.1:9100/metrics",
+			wantLabels: map[string]string{"env": "production", "environment": "prod"},
+		},
+		{
+			name:   "empty replacement deletes",
+			labels: map[string]string{"env": "prod"},
+			rules: []RelabelConfig{
+				{SourceLabels: []string{"missing"}, TargetLabel: "env"},
+			},
+			wantKeep:   true,
+			wantURL:    "http://10.0.0.1:9100/metrics",
+			wantLabels: map[string]string{},
+		},
+		{
+			name:   "url",
+			labels: map[string]string{"port": "9200"},
+			rules: []RelabelConfig{
+				{TargetLabel: "__scheme__", Replacement: "https"},
+				{SourceLabels: []string{"__address__", "port"}, Regex: "([^:]+):\\d+;(\\d+)", TargetLabel: "__address__", Replacement: "$1:$2"},
+				{TargetLabel: "__metrics_path__", Replacement: "/probe"},
+				{Action: "labeldrop", Regex: "port"},
+			},
+			wantKeep:   true,
+			wantURL:    "https://10.0.0.1:9200/probe",
+			wantLabels: map[string]string{},
+		},
+		{
+			name:       "keep",
+			labels:     map[string]string{"env": "prod"},
+			rules:      []RelabelConfig{{Action: "keep", SourceLabels: []string{"env"}, Regex: "prod|staging"}},
+			wantKeep:   true,
+			wantURL:    "http://10.0.0.1:9100/metrics",
+			wantLabels: map[string]string{"env": "prod"},
+		},
+		{
+			name:   "keep drops",
+			labels: map[string]string{"env": "dev"},
+			rules:  []RelabelConfig{{Action: "keep", SourceLabels: []string{"env"}, Regex: "prod|staging"}},
+		},
+		{
+			name:   "drop",
+			labels: map[string]string{"env": "dev"},
+			rules:  []RelabelConfig{{Action: "drop", SourceLabels: []string{"env"}, Regex: "dev"}},
+		},
+		{
+			name:   "labelmap",
+			labels: map[string]string{"__meta_zone": "eu1", "env": "prod"},
+			rules: []RelabelConfig{
+				{Action: "labelmap", Regex: "__meta_(.+)"},
+			},
+			wantKeep:   true,
+			wantURL:    "http://10.0.0.1:9100/metrics",
+			wantLabels: map[string]string{"env": "prod", "zone": "eu1"},
+		},
+		{
+			name:   "labelkeep",
+			labels: map[string]string{"env": "prod", "team": "db", "zone": "eu1"},
+			rules: []RelabelConfig{
+				{Action: "labelkeep", Regex: "env|__.*"},
+			},
+			wantKeep:   true,
+			wantURL:    "http://10.0.0.1:9100/metrics",
+			wantLabels: map[string]string{"env": "prod"},
+		},
+		{
+			name:    "unknown action",
+			rules:   []RelabelConfig{{Action: "lowercase"}},
+			wantErr: true,
+		},
+		{
+			name:    "replace without target_label",
+			rules:   []RelabelConfig{{SourceLabels: []string{"env"}}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid regex",
+			rules:   []RelabelConfig{{Action: "drop", Regex: "("}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			target := Target{URL: "http://10.0.0.1:9100/metrics", Labels: tt.labels, RelabelConfigs: tt.rules}
+			keep, err := relabelTarget(&target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if keep != tt.wantKeep {
+				t.Fatalf("got keep %v, want %v", keep, tt.wantKeep)
+			}
+			if !keep {
+				return
+			}
+			if target.URL != tt.wantURL {
+				t.Errorf("got URL %s, want %s", target.URL, tt.wantURL)
+			}
+			if !reflect.DeepEqual(target.Labels, tt.wantLabels) {
+				t.Errorf("got labels %v, want %v", target.Labels, tt.wantLabels)
+			}
+		})
+	}
+}
+
+func TestRelabelTargetHashmod(t *testing.T) {
+	shards := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		target := Target{
+			URL:            "http://10.0.0." + strconv.Itoa(i) + ":9100/metrics",
+			Labels:         map[string]string{},
+			RelabelConfigs: []RelabelConfig{{Action: "hashmod", SourceLabels: []string{"__address__"}, TargetLabel: "shard", Modulus: 3}},
+		}
+		again := target
+		again.Labels = map[string]string{}
+		if _, err := relabelTarget(&target); err != nil {
+			t.Fatal(err)
+		}
+		relabelTarget(&again)
+		shard := target.Labels["shard"]
+		if n, err := strconv.Atoi(shard); err != nil || n < 0 || n >= 3 {
+			t.Fatalf("got shard %q for %s, want 0, 1 or 2", shard, target.URL)
+		}
+		if again.Labels["shard"] != shard {
+			t.Errorf("got shards %s and %s for %s, want the same", shard, again.Labels["shard"], target.URL)
+		}
+		shards[shard] = true
+	}
+	if len(shards) != 3 {
+		t.Errorf("got shards %v for 20 targets, want all of 0, 1 and 2", shards)
+	}
+}
+
+func TestRelabelConfigsDropTarget(t *testing.T) {
+	cfg := loadTestConfig(t, `targets:
+  - url: http://10.0.0.1:9100/metrics
+    labels:
+      env: prod
+  - url: http://10.0.0.2:9100/metrics
+    labels:
+      env: dev
+    relabel_configs:
+      - source_labels: [env]
+        regex: dev
+        action: drop
+`)
+	if len(cfg.Targets) != 1 || cfg.Targets[0].URL != "http://10.0.0.1:9100/metrics" {
+		t.Errorf("got targets %v, want only http://10.0.0.1:9100/metrics", cfg.Targets)
+	}
+}
+
+func TestMetricRelabelConfigs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		input  string
+		want   string
+	}{
+		{
+			name:   "drop series",
+			config: "metric_relabel_configs:\n  - source_labels: [__name__, code]\n    regex: requests_total;5..\n    action: drop",
+			input: `# TYPE requests_total counter
+requests_total{code="200"} 10
+requests_total{code="500"} 1
+`,
+			want: `# TYPE requests_total counter
+requests_total{code="200"} 10
+`,
+		},
+		{
+			name:   "drop family",
+			config: "metric_relabel_configs:\n  - source_labels: [__name__]\n    regex: go_.*\n    action: drop",
+			input: `# TYPE go_goroutines gauge
+go_goroutines 10
+# TYPE up gauge
+up 1
+`,
+			want: `# TYPE up gauge
+up 1
+`,
+		},
+		{
+			name:   "rewrite label",
+			config: "metric_relabel_configs:\n  - source_labels: [device]\n    regex: /dev/(.+)\n    target_label: device",
+			input: `# TYPE node_disk_io_time_seconds_total counter
+node_disk_io_time_seconds_total{device="/dev/sda"} 1
+`,
+			want: `# TYPE node_disk_io_time_seconds_total counter
+node_disk_io_time_seconds_total{device="sda"} 1
+`,
+		},
+		{
+			name:   "rename series",
+			config: "metric_relabel_configs:\n  - source_labels: [__name__, code]\n    regex: requests_total;(5..)\n    target_label: __name__\n    replacement: errors_total",
+			input: `# TYPE requests_total counter
+requests_total{code="200"} 10
+requests_total{code="500"} 1
+`,
+			want: `# TYPE errors_total counter
+errors_total{code="500"} 1
+# TYPE requests_total counter
+requests_total{code="200"} 10
+`,
+		},
+		{
+			name:   "rename into another type",
+			config: "metric_relabel_configs:\n  - source_labels: [__name__]\n    regex: a\n    target_label: __name__\n    replacement: b",
+			input: `# TYPE a gauge
+a 1
+# TYPE b counter
+b 2
+`,
+			want: `# TYPE b counter
+b 2
+`,
+		},
+		{
+			name:   "labeldrop",
+			config: "metric_relabel_configs:\n  - regex: pod_.*\n    action: labeldrop",
+			input: `# TYPE up gauge
+up{job="node",pod_name="a",pod_ip="10.0.0.1"} 1
+`,
+			want: `# TYPE up gauge
+up{job="node"} 1
+`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			checkTransform(t, tt.config, tt.input, tt.want)
+		})
+	}
+}
+
+func TestMetricRelabelTypeMismatch(t *testing.T) {
+	target := testTarget(t, "metric_relabel_configs:\n  - source_labels: [__name__]\n    regex: a\n    target_label: __name__\n    replacement: b")
+	mismatches := relabelTypeMismatchesTotal.WithLabelValues(target.URL)
+	before := counterValue(t, mismatches)
+	transformMetrics(target, parseText(t, "# TYPE a gauge\na{i=\"1\"} 1\na{i=\"2\"} 2\n# TYPE b counter\nb 2\n"))
+	if got := counterValue(t, mismatches) - before; got != 2 {
+		t.Errorf("got %v series counted as dropped, want 2", got)
+	}
+}
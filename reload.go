@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	// activeConfig is the config in effect, swapped as a whole on reload so
+	// that each scrape sees a consistent one.
+	activeConfig atomic.Pointer[Config]
+
+	// reloadMu serializes reloads.
+	reloadMu sync.Mutex
+
+	// activeMux routes requests to the endpoints enabled by the config in
+	// effect, rebuilt on reload.
+	activeMux atomic.Pointer[http.ServeMux]
+)
+
+// newMux returns the mux routing requests to the endpoints enabled by cfg,
+// loaded from configPath.
+func newMux(cfg *Config, configPath string) *http.ServeMux {
+	// A mux of our own keeps anything registering on the default one, like
+	// net/http/pprof, off the main listener.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/metrics/", handleMetrics)
+	mux.HandleFunc("/-/healthy", handleHealthy)
+	mux.HandleFunc("/-/ready", handleReady)
+	mux.HandleFunc("/targets", handleTargets)
+	mux.HandleFunc("/service-discovery", handleServiceDiscovery)
+	mux.HandleFunc("/", handleStatus)
+	if cfg.TelemetryPath != "" {
+		mux.Handle(cfg.TelemetryPath, handleTelemetry)
+	}
+	if cfg.ReloadEndpoint {
+		mux.HandleFunc("/-/reload", handleReload(configPath))
+	}
+	if cfg.Graphite != nil {
+		mux.HandleFunc(cfg.Graphite.Path, handleGraphite)
+	}
+	if cfg.DebugEndpoints {
+		mux.HandleFunc("/debug/preview", limitOutput(handlePreview))
+		mux.HandleFunc("/api/v1/metadata", limitOutput(handleMetadata))
+		mux.HandleFunc("/report", limitOutput(handleReport))
+	}
+	return mux
+}
+
+// serveActiveMux serves r with the mux in effect.
+func serveActiveMux(w http.ResponseWriter, r *http.Request) {
+	mux := activeMux.Load()
+	instrumentRequests(mux, allowClients(requireAuth(mux))).ServeHTTP(w, r)
+}
+
+// currentConfig returns the config in effect.
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+// applyConfig makes cfg the config in effect, starting its service discovery
+// and stopping that of the previous one. Discoverers whose config didn't
+// change are carried over, so their targets don't go missing until the next
+// refresh.
+func applyConfig(cfg *Config) {
+	old := currentConfig()
+	var kept map[discoverer]bool
+	for _, sd := range cfg.sdConfigs() {
+		var d discoverer
+		if old != nil {
+			for _, od := range old.discoverers {
+				if !kept[od] && reflect.DeepEqual(od.config(), sd) {
+					d = od
+					break
+				}
+			}
+		}
+		if d == nil {
+			d = newDiscoverer(sd)
+			go d.run()
+		} else {
+			if kept == nil {
+				kept = map[discoverer]bool{}
+			}
+			kept[d] = true
+		}
+		cfg.discoverers = append(cfg.discoverers, d)
+	}
+	if cfg.vault != nil {
+		go cfg.vault.renewToken()
+	}
+	activeConfig.Store(cfg)
+	if err := setConfigHash(cfg); err != nil {
+		log.Printf("failed to hash config: %v", err)
+	}
+	if old == nil {
+		return
+	}
+	for _, d := range old.discoverers {
+		if !kept[d] {
+			d.stop()
+		}
+	}
+	pruneTargets()
+	if old.vault != nil {
+		old.vault.stop()
+	}
+	// Scrapes still in flight keep using the clients of the old targets, so
+	// only their idle connections can be closed.
+	for _, t := range old.Targets {
+		if t.client != nil {
+			t.client.CloseIdleConnections()
+		}
+	}
+}
+
+// reloadConfig loads the config from path and makes it the one in effect. If
+// it fails to load, the config in effect is kept.
+func reloadConfig(path string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	old := currentConfig()
+	// These are only used when starting up.
+	if cfg.Listen != old.Listen || !reflect.DeepEqual(cfg.TLS, old.TLS) ||
+		cfg.PprofListen != old.PprofListen || cfg.ScrapeInterval > 0 && old.ScrapeInterval <= 0 {
+		warnf("changes to listen, tls, pprof_listen and enabling scrape_interval take effect on restart")
+	}
+	applyConfig(cfg)
+	// The endpoints enabled may have changed along with their paths.
+	activeMux.Store(newMux(cfg, path))
+	return nil
+}
+
+// reloadOnSIGHUP reloads the config from path whenever SIGHUP is received.
+func reloadOnSIGHUP(path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := reloadConfig(path); err != nil {
+			log.Printf("failed to reload config, keeping the current one: %v", err)
+			continue
+		}
+		infof("reloaded config from %s", path)
+	}
+}
+
+// handleReload returns the handler of the /-/reload endpoint, reloading the
+// config from path on POST requests.
+func handleReload(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadConfig(path); err != nil {
+			log.Printf("failed to reload config, keeping the current one: %v", err)
+			http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		infof("reloaded config from %s", path)
+		fmt.Fprintln(w, "reloaded")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// discoverer is a service discovery mechanism keeping a set of targets up to
+// date in the background.
+type discoverer interface {
+	// run refreshes the targets periodically until stopped.
+	run()
+	stop()
+	refresh() error
+	// Targets returns the last successfully discovered targets.
+	Targets() []Target
+	// Sample returns the targets to scrape this time around.
+	Sample() []Target
+	// config returns the config the discoverer was created from, to tell
+	// whether it can be carried over to a reloaded config.
+	config() interface{}
+	// source describes where targets are discovered from, for logs.
+	source() string
+}
+
+// poller runs the periodic refresh of a discoverer. Discoverers embed it and
+// only implement refreshing and keeping their targets.
+type poller struct {
+	d        discoverer
+	interval time.Duration
+	// done is closed to stop refreshing.
+	done chan struct{}
+}
+
+func newPoller(d discoverer, interval time.Duration) poller {
+	return poller{d: d, interval: interval, done: make(chan struct{})}
+}
+
+// run refreshes the targets every refresh interval until stopped. If a
+// refresh fails, the discoverer keeps its last discovered targets.
+func (p *poller) run() {
+	for {
+		if err := p.d.refresh(); err != nil {
+			warnf("failed to refresh targets from %s: %v", p.d.source(), err)
+		}
+		pruneTargets()
+		select {
+		case <-p.done:
+			return
+		case <-time.After(p.interval):
+		}
+	}
+}
+
+// stop makes run return after any refresh in progress.
+func (p *poller) stop() {
+	close(p.done)
+}
+
+// Sample returns all targets, as discovered targets aren't sampled unless the
+// discoverer overrides it.
+func (p *poller) Sample() []Target {
+	return p.d.Targets()
+}
+
+// setSDDefaults sets the refresh interval, scheme and metrics path shared by
+// the service discovery configs to their defaults if unset.
+func setSDDefaults(interval *time.Duration, scheme, metricsPath *string, defaultInterval time.Duration) {
+	if *interval <= 0 {
+		*interval = defaultInterval
+	}
+	if *scheme == "" {
+		*scheme = "http"
+	}
+	if *metricsPath == "" {
+		*metricsPath = "/metrics"
+	}
+}
+
+// newDiscoverer returns the discoverer configured by cfg, which is one of
+// the service discovery configs.
+func newDiscoverer(cfg interface{}) discoverer {
+	switch cfg := cfg.(type) {
+	case HTTPSDConfig:
+		return newHTTPSD(cfg)
+	case FileSDConfig:
+		return newFileSD(cfg)
+	case DNSSDConfig:
+		return newDNSSD(cfg)
+	case KubernetesSDConfig:
+		return newKubernetesSD(cfg)
+	case ConsulSDConfig:
+		return newConsulSD(cfg)
+	case DockerSDConfig:
+		return newDockerSD(cfg)
+	}
+	panic("unknown service discovery config")
+}
+
+// sdConfigs returns the service discovery configs of c.
+func (c *Config) sdConfigs() []interface{} {
+	var configs []interface{}
+	for _, sd := range c.HTTPSD {
+		configs = append(configs, sd)
+	}
+	for _, sd := range c.FileSD {
+		configs = append(configs, sd)
+	}
+	for _, sd := range c.DNSSD {
+		configs = append(configs, sd)
+	}
+	for _, sd := range c.KubernetesSD {
+		configs = append(configs, sd)
+	}
+	for _, sd := range c.ConsulSD {
+		configs = append(configs, sd)
+	}
+	for _, sd := range c.DockerSD {
+		configs = append(configs, sd)
+	}
+	return configs
+}
+
+// targetGroup is a group of targets in the Prometheus format shared by HTTP
+// and file service discovery.
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// groupTargets turns target groups into targets, building their URLs from
+// the host:port pairs with scheme and path unless overridden by the
+// __scheme__ and __metrics_path__ labels of a group.
+func groupTargets(groups []targetGroup, scheme, path string, dropLabels []string) []Target {
+	var targets []Target
+	for _, g := range groups {
+		scheme, path := scheme, path
+		if s, ok := g.Labels["__scheme__"]; ok {
+			scheme = s
+		}
+		if p, ok := g.Labels["__metrics_path__"]; ok {
+			path = p
+		}
+		// Labels starting with __ are reserved for internal use and are not
+		// injected into the metrics.
+		labels := map[string]string{}
+		for k, v := range g.Labels {
+			if !strings.HasPrefix(k, "__") {
+				labels[k] = v
+			}
+		}
+		for _, name := range dropLabels {
+			delete(labels, name)
+		}
+		for _, addr := range g.Targets {
+			targets = append(targets, Target{
+				URL:    scheme + "://" + addr + path,
+				Labels: labels,
+			})
+		}
+	}
+	return targets
+}
+
+// discoveredTargets validates the targets discovered from source and sets
+// their defaults the way static targets get them when the config is loaded.
+// As discovered targets can't be fixed in the config, targets with invalid
+// URLs and labels with invalid names are left out with a warning rather than
+// failing the refresh.
+func discoveredTargets(targets []Target, source string) []Target {
+	valid := targets[:0]
+	for _, t := range targets {
+		if err := validateTargetURL(t.URL); err != nil {
+			warnf("dropping target discovered from %s: %v", source, err)
+			continue
+		}
+		// The labels may be shared by the targets of a group.
+		labels := make(map[string]string, len(t.Labels))
+		for name, value := range t.Labels {
+			if !model.LabelName(name).IsValid() {
+				warnf("dropping label %q of target %s discovered from %s: invalid label name", name, t.URL, source)
+				continue
+			}
+			labels[name] = value
+		}
+		t.Labels = labels
+		t.labelsSerialized = serializeLabels(labels)
+		setTargetDefaults(&t)
+		valid = append(valid, t)
+	}
+	return valid
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v3"
+)
+
+// registry holds the exporter's own metrics, which are served along with the
+// metrics collected from targets.
+var registry = prometheus.NewRegistry()
+
+var scrapeBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pue_scrape_bytes_total",
+	Help: "Total number of decompressed body bytes read from targets.",
+}, []string{"instance"})
+
+var targetSeriesTruncated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pue_target_series_truncated",
+	Help: "Whether the series of the target were truncated to its max_series in the last scrape.",
+}, []string{"instance"})
+
+var targetExceededSampleLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pue_target_exceeded_sample_limit",
+	Help: "Whether the metrics of the target were dropped in the last scrape for exceeding its sample_limit.",
+}, []string{"instance"})
+
+var targetSampled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pue_target_sampled",
+	Help: "Whether the discovered target was included in the last sample of its http_sd.",
+}, []string{"instance"})
+
+var (
+	concurrentScrapes = newHighWaterMark(prometheus.GaugeOpts{
+		Name: "pue_max_concurrent_scrapes",
+		Help: "Highest number of targets being scraped concurrently since startup.",
+	})
+	openConnections = newHighWaterMark(prometheus.GaugeOpts{
+		Name: "pue_max_open_connections",
+		Help: "Highest number of connections open to targets at once since startup.",
+	})
+)
+
+var targetCertExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pue_target_cert_expiry_timestamp_seconds",
+	Help: "Expiry time of the certificate presented by the HTTPS target, in seconds since epoch.",
+}, []string{"instance"})
+
+var targetBreakerOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pue_target_breaker_open",
+	Help: "Whether the circuit breaker of the target is open, skipping it until its cooldown is over.",
+}, []string{"instance", "target"})
+
+var targetStale = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pue_target_stale",
+	Help: "Whether the metrics of the target served in the last scrape are from an earlier successful scrape, as it failed.",
+}, []string{"instance"})
+
+var targetCacheAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pue_target_cache_age_seconds",
+	Help: "Age of the cached metrics of the target served in the last scrape, in seconds, 0 if just fetched.",
+}, []string{"instance", "target"})
+
+var configHash = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pue_config_hash",
+	Help: "Hash of the effective config, as the hash label. Always 1.",
+}, []string{"hash"})
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pue_http_requests_total",
+		Help: "Total number of HTTP requests received, by handler and status code.",
+	}, []string{"handler", "code"})
+	targetFetchErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pue_target_fetch_errors_total",
+		Help: "Total number of failed fetches from the target, retries included.",
+	}, []string{"instance"})
+	targetParseErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pue_target_parse_errors_total",
+		Help: "Total number of responses of the target which failed to parse.",
+	}, []string{"instance"})
+	relabelTypeMismatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pue_target_relabel_type_mismatches_total",
+		Help: "Total number of series of the target dropped for being renamed by metric_relabel_configs into a family of a different type.",
+	}, []string{"instance"})
+	responseBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pue_response_bytes_total",
+		Help: "Total number of bytes of metrics served, after compression.",
+	})
+)
+
+// runtimeRegistry holds the standard Go runtime and process metrics of the
+// exporter. They are only served on the telemetry_path, as they would
+// otherwise clash with the same metrics of targets.
+var runtimeRegistry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(scrapeBytesTotal, targetSeriesTruncated, targetExceededSampleLimit, targetSampled,
+		concurrentScrapes.gauge, openConnections.gauge, configHash, targetCertExpiry,
+		targetBreakerOpen, targetStale, httpRequestsTotal, targetFetchErrorsTotal,
+		targetParseErrorsTotal, responseBytesTotal, targetCacheAge, relabelTypeMismatchesTotal)
+	runtimeRegistry.MustRegister(collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// instrumentRequests wraps h to count requests in httpRequestsTotal, by the
+// pattern of the handler they are routed to by mux.
+func instrumentRequests(mux *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		counter := httpRequestsTotal.MustCurryWith(prometheus.Labels{"handler": pattern})
+		promhttp.InstrumentHandlerCounter(counter, h).ServeHTTP(w, r)
+	})
+}
+
+// handleTelemetry serves the exporter's own metrics, along with the Go
+// runtime and process ones.
+var handleTelemetry = promhttp.HandlerFor(prometheus.Gatherers{registry, runtimeRegistry}, promhttp.HandlerOpts{})
+
+// setGauge sets g to 1 if b is true, and 0 otherwise.
+func setGauge(g prometheus.Gauge, b bool) {
+	if b {
+		g.Set(1)
+	} else {
+		g.Set(0)
+	}
+}
+
+// setConfigHash exposes the hash of the effective config c, defaults
+// included, so that instances running different configs can be told apart.
+func setConfigHash(c *Config) error {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	configHash.Reset()
+	configHash.WithLabelValues(hex.EncodeToString(sum[:])).Set(1)
+	return nil
+}
+
+// countingReader adds the number of bytes read through it to a counter.
+type countingReader struct {
+	r io.Reader
+	c prometheus.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.c.Add(float64(n))
+	return n, err
+}
+
+// highWaterMark tracks a count and exports the highest it's ever been.
+type highWaterMark struct {
+	gauge prometheus.Gauge
+
+	mu  sync.Mutex
+	n   int
+	max int
+}
+
+func newHighWaterMark(opts prometheus.GaugeOpts) *highWaterMark {
+	return &highWaterMark{gauge: prometheus.NewGauge(opts)}
+}
+
+func (h *highWaterMark) Inc() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.n++
+	if h.n > h.max {
+		h.max = h.n
+		h.gauge.Set(float64(h.max))
+	}
+}
+
+func (h *highWaterMark) Dec() {
+	h.mu.Lock()
+	h.n--
+	h.mu.Unlock()
+}
+
+// targetMetrics returns metric families describing the outcome of scraping
+// each target, labeled with the URL of the target as instance along with
+// its labels.
+func targetMetrics(results []scrapeResult) []*dto.MetricFamily {
+	// Families without metrics can't be encoded.
+	if len(results) == 0 {
+		return nil
+	}
+	up := newMetricFamily("pue_target_up", "Whether the target was scraped successfully.", dto.MetricType_GAUGE)
+	duration := newMetricFamily("pue_target_scrape_duration_seconds", "Time taken to scrape the target.", dto.MetricType_GAUGE)
+	samples := newMetricFamily("pue_target_scrape_samples_scraped", "Number of samples served from the target after transformation.", dto.MetricType_GAUGE)
+	for _, res := range results {
+		labels := targetLabelPairs(res.target)
+		v := 0.0
+		if res.err == nil {
+			v = 1
+		}
+		d := res.duration.Seconds()
+		n := float64(countSamples(res.metricFamilies))
+		up.Metric = append(up.Metric, &dto.Metric{Label: labels, Gauge: &dto.Gauge{Value: &v}})
+		duration.Metric = append(duration.Metric, &dto.Metric{Label: labels, Gauge: &dto.Gauge{Value: &d}})
+		samples.Metric = append(samples.Metric, &dto.Metric{Label: labels, Gauge: &dto.Gauge{Value: &n}})
+	}
+	return []*dto.MetricFamily{up, duration, samples}
+}
+
+// countSamples returns the number of samples of the metric families as
+// exposed in the text format, where e.g. each bucket of a histogram is a
+// sample.
+func countSamples(mfs map[string]*dto.MetricFamily) int {
+	n := 0
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			switch {
+			case m.Summary != nil:
+				n += len(m.Summary.Quantile) + 2
+			case m.Histogram != nil:
+				n += len(m.Histogram.Bucket) + 2
+				if b := m.Histogram.Bucket; len(b) == 0 || !math.IsInf(b[len(b)-1].GetUpperBound(), 1) {
+					n++ // the implicit +Inf bucket
+				}
+			default:
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func newMetricFamily(name, help string, typ dto.MetricType) *dto.MetricFamily {
+	return &dto.MetricFamily{Name: &name, Help: &help, Type: &typ}
+}
+
+// targetLabelPairs returns the labels identifying target t in the exporter's
+// own metrics.
+func targetLabelPairs(t Target) []*dto.LabelPair {
+	instance, url := "instance", t.URL
+	labels := []*dto.LabelPair{{Name: &instance, Value: &url}}
+	for k, v := range t.Labels {
+		if k == instance {
+			continue
+		}
+		k, v := k, v
+		labels = append(labels, &dto.LabelPair{Name: &k, Value: &v})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+	return labels
+}
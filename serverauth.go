@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ServerAuth configures authenticating the clients of the exporter.
+type ServerAuth struct {
+	Basic *ServerBasicAuth `yaml:"basic"`
+}
+
+// ServerBasicAuth is the credentials clients must send using HTTP basic
+// authentication.
+type ServerBasicAuth struct {
+	Username string `yaml:"username"`
+	// PasswordHash is the bcrypt hash of the password, as generated by
+	// htpasswd -nB.
+	PasswordHash string `yaml:"password_hash"`
+}
+
+// validate checks the credentials are usable.
+func (a *ServerBasicAuth) validate() error {
+	if a.Username == "" {
+		return fmt.Errorf("username must be set")
+	}
+	if _, err := bcrypt.Cost([]byte(a.PasswordHash)); err != nil {
+		return fmt.Errorf("password_hash: %w", err)
+	}
+	return nil
+}
+
+// verifiedPasswords caches the SHA-256 of passwords already verified against
+// their bcrypt hash, which is deliberately slow to compute, so that it
+// isn't computed again on every scrape.
+var verifiedPasswords sync.Map
+
+// authenticate checks the credentials of the request.
+func (a *ServerBasicAuth) authenticate(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(a.Username)) != 1 {
+		return false
+	}
+	key := sha256.Sum256([]byte(a.PasswordHash + "\x00" + pass))
+	if _, ok := verifiedPasswords.Load(key); ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(pass)) != nil {
+		return false
+	}
+	verifiedPasswords.Store(key, struct{}{})
+	return true
+}
+
+// requireAuth wraps h to reject requests not authenticated as configured by
+// the auth block of the config in effect.
+func requireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := currentConfig().Auth; auth != nil && auth.Basic != nil && !auth.Basic.authenticate(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="prometheus-unified-exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowClients wraps h to reject requests from addresses outside the
+// listen_allow_cidrs of the config in effect.
+func allowClients(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowed := currentConfig().allowedPrefixes; len(allowed) > 0 && !isAllowed(r.RemoteAddr, allowed) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isAllowed reports whether the address, as found in http.Request.RemoteAddr,
+// is in one of the allowed prefixes.
+func isAllowed(remoteAddr string, allowed []netip.Prefix) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, p := range allowed {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// SigV4 configures signing the requests made to a target with AWS Signature
+// Version 4.
+type SigV4 struct {
+	// Region is the AWS region, taken from the AWS config and env vars if
+	// not set.
+	Region string `yaml:"region"`
+	// AccessKey and SecretKey are static credentials. If not set,
+	// credentials are looked up through the default chain of env vars,
+	// shared credentials file and instance or task role.
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// SecretKeyFile is the path of a file holding the secret key, read when
+	// the config is loaded, instead of SecretKey.
+	SecretKeyFile string `yaml:"secret_key_file"`
+	// Profile is the profile of the shared credentials file to use.
+	Profile string `yaml:"profile"`
+	// RoleARN, if set, is a role assumed with the above credentials.
+	RoleARN string `yaml:"role_arn"`
+	// Service is the name of the service the target belongs to, execute-api
+	// by default as for endpoints behind API Gateway.
+	Service string `yaml:"service"`
+}
+
+// sigV4Auth authenticates by signing requests with AWS Signature Version 4.
+type sigV4Auth struct {
+	signer  *v4.Signer
+	region  string
+	service string
+}
+
+func newSigV4Auth(c SigV4, vault *vaultClient) (*sigV4Auth, error) {
+	if c.SecretKeyFile != "" {
+		if c.SecretKey != "" {
+			return nil, fmt.Errorf("at most one of secret_key and secret_key_file can be set")
+		}
+		secret, err := readSecretFile(c.SecretKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.SecretKey = secret
+	}
+	secret, err := vault.expand(c.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	c.SecretKey = secret
+	if (c.AccessKey == "") != (c.SecretKey == "") {
+		return nil, fmt.Errorf("access_key and secret_key must both be set")
+	}
+	var creds *credentials.Credentials
+	if c.AccessKey != "" {
+		creds = credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, "")
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region:      aws.String(c.Region),
+			Credentials: creds,
+		},
+		Profile:           c.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	region := aws.StringValue(sess.Config.Region)
+	if region == "" {
+		return nil, fmt.Errorf("region must be set")
+	}
+	creds = sess.Config.Credentials
+	if c.RoleARN != "" {
+		creds = stscreds.NewCredentials(sess, c.RoleARN)
+	}
+	service := c.Service
+	if service == "" {
+		service = "execute-api"
+	}
+	return &sigV4Auth{signer: v4.NewSigner(creds), region: region, service: service}, nil
+}
+
+func (a *sigV4Auth) Apply(req *http.Request) error {
+	_, err := a.signer.Sign(req, nil, a.service, a.region, time.Now())
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// snapshot is the outcome of a background scrape.
+type snapshot struct {
+	at             time.Time
+	metricFamilies map[string]*dto.MetricFamily
+	// groups holds the merged metrics of the targets of each group.
+	groups  map[string]map[string]*dto.MetricFamily
+	results []scrapeResult
+}
+
+// latestSnapshot is the outcome of the latest background scrape, served
+// instead of scraping targets on every request when scrape_interval is set.
+var latestSnapshot atomic.Pointer[snapshot]
+
+// scrapeInBackground collates metrics every scrape_interval until it's unset
+// by a config reload, keeping the latest in latestSnapshot.
+func scrapeInBackground() {
+	for {
+		cfg := currentConfig()
+		if cfg.ScrapeInterval <= 0 {
+			latestSnapshot.Store(nil)
+			return
+		}
+		start := time.Now()
+		results := scrapeGroup(context.Background(), cfg, "")
+		// Groups are merged first, as merging all targets modifies their
+		// metrics.
+		groups := mergeGroups(cfg, results)
+		metricFamilies := mergeResults(cfg, results, "")
+		if cfg.TimestampSamples {
+			setTimestamps(metricFamilies, start)
+			for _, mfs := range groups {
+				setTimestamps(mfs, start)
+			}
+		}
+		latestSnapshot.Store(&snapshot{at: start, metricFamilies: metricFamilies, groups: groups, results: results})
+		time.Sleep(time.Until(start.Add(cfg.ScrapeInterval)))
+	}
+}
+
+// gatherMetrics returns the metrics of group, or of all targets if empty, to
+// serve and the outcome of scraping each of its targets, along with when
+// targets were scraped. That's the latest background
+// scrape if there is one, or else a scrape done now. The returned metric
+// families must not be modified, as they may be served concurrently.
+func gatherMetrics(ctx context.Context, group string) (map[string]*dto.MetricFamily, []scrapeResult, time.Time) {
+	if s := latestSnapshot.Load(); s != nil {
+		snapshotFamilies := s.metricFamilies
+		if group != "" {
+			snapshotFamilies = s.groups[group]
+		}
+		metricFamilies := make(map[string]*dto.MetricFamily, len(snapshotFamilies)+1)
+		for name, mf := range snapshotFamilies {
+			metricFamilies[name] = mf
+		}
+		age := newMetricFamily("pue_cache_age_seconds", "Age of the served snapshot of the background scrape, in seconds.", dto.MetricType_GAUGE)
+		v := time.Since(s.at).Seconds()
+		age.Metric = []*dto.Metric{{Gauge: &dto.Gauge{Value: &v}}}
+		metricFamilies[age.GetName()] = age
+		return metricFamilies, groupResults(s.results, group), s.at
+	}
+	now := time.Now()
+	metricFamilies, results := collateMetrics(ctx, group)
+	if currentConfig().TimestampSamples {
+		setTimestamps(metricFamilies, now)
+	}
+	return metricFamilies, results, now
+}
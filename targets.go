@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// targetStatus is the outcome of the last scrape of a target.
+type targetStatus struct {
+	LastScrape time.Time
+	Duration   time.Duration
+	Samples    int
+	Err        error
+	// RecentErrors is the errors of the last failed scrapes, most recent
+	// first.
+	RecentErrors []scrapeError
+}
+
+// scrapeError is the error of a failed scrape.
+type scrapeError struct {
+	Time time.Time
+	Err  string
+}
+
+// maxRecentErrors is the number of errors kept in targetStatus.RecentErrors.
+const maxRecentErrors = 5
+
+var (
+	targetStatusesMu sync.Mutex
+	// targetStatuses is the outcome of the last scrape of targets, by URL.
+	targetStatuses = map[string]targetStatus{}
+)
+
+// recordTargetStatuses remembers the outcome of scraping targets at start,
+// forgetting about targets no longer active.
+func recordTargetStatuses(cfg *Config, start time.Time, results []scrapeResult) {
+	active := map[string]bool{}
+	for _, t := range activeTargets(cfg) {
+		active[t.URL] = true
+	}
+	targetStatusesMu.Lock()
+	defer targetStatusesMu.Unlock()
+	for _, res := range results {
+		status := targetStatus{
+			LastScrape:   start,
+			Duration:     res.duration,
+			Samples:      countSamples(res.metricFamilies),
+			Err:          res.err,
+			RecentErrors: targetStatuses[res.target.URL].RecentErrors,
+		}
+		if res.err != nil {
+			recent := append([]scrapeError{{start, res.err.Error()}}, status.RecentErrors...)
+			if len(recent) > maxRecentErrors {
+				recent = recent[:maxRecentErrors]
+			}
+			status.RecentErrors = recent
+		}
+		targetStatuses[res.target.URL] = status
+	}
+	for url := range targetStatuses {
+		if !active[url] {
+			delete(targetStatuses, url)
+		}
+	}
+}
+
+// targetInfo describes an active target in the response of /targets.
+type targetInfo struct {
+	URL        string            `json:"url"`
+	Labels     map[string]string `json:"labels"`
+	Health     string            `json:"health"`
+	LastScrape *time.Time        `json:"last_scrape,omitempty"`
+	Duration   float64           `json:"last_scrape_duration_seconds"`
+	LastError  string            `json:"last_error"`
+}
+
+// handleTargets lists the active targets along with the outcome of their
+// last scrape, in JSON. The health of targets not scraped yet is unknown.
+func handleTargets(w http.ResponseWriter, r *http.Request) {
+	targets := activeTargets(currentConfig())
+	infos := make([]targetInfo, 0, len(targets))
+	targetStatusesMu.Lock()
+	for _, t := range targets {
+		info := targetInfo{URL: t.URL, Labels: t.Labels, Health: "unknown"}
+		if status, ok := targetStatuses[t.URL]; ok {
+			info.Health = "up"
+			if status.Err != nil {
+				info.Health = "down"
+				info.LastError = status.Err.Error()
+			}
+			lastScrape := status.LastScrape
+			info.LastScrape = &lastScrape
+			info.Duration = status.Duration.Seconds()
+		}
+		infos = append(infos, info)
+	}
+	targetStatusesMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"targets": infos})
+}
+
+// handleServiceDiscovery lists the active targets in the Prometheus HTTP
+// service discovery format, so that Prometheus can scrape them directly.
+func handleServiceDiscovery(w http.ResponseWriter, r *http.Request) {
+	targets := activeTargets(currentConfig())
+	groups := make([]targetGroup, 0, len(targets))
+	for _, t := range targets {
+		u, err := url.Parse(t.URL)
+		if err != nil {
+			continue
+		}
+		labels := map[string]string{
+			"__scheme__":       u.Scheme,
+			"__metrics_path__": u.Path,
+		}
+		for name, values := range u.Query() {
+			labels["__param_"+name] = values[0]
+		}
+		for k, v := range t.Labels {
+			labels[k] = v
+		}
+		groups = append(groups, targetGroup{Targets: []string{u.Host}, Labels: labels})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig configures serving metrics over HTTPS.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile, if set, is a PEM file of the CAs client certificates
+	// must be signed by. Clients without a valid certificate are rejected.
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// TargetTLSConfig configures TLS for connecting to a target.
+type TargetTLSConfig struct {
+	// ServerName is sent for SNI and verified against the certificate of
+	// the target instead of the host of its URL, e.g. when scraping by IP
+	// behind a load balancer selecting backends by SNI.
+	ServerName string `yaml:"server_name"`
+	// CAFile is a PEM file of the CAs to verify the certificate of the
+	// target with, instead of the system ones.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the client certificate presented to the
+	// target, reloaded when they change like the server one.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// InsecureSkipVerify disables verifying the certificate of the target.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// tlsConfig returns the TLS config for connecting to the target.
+func (c *TargetTLSConfig) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must both be set")
+	}
+	if c.CertFile != "" {
+		certs := &certReloader{certFile: c.CertFile, keyFile: c.KeyFile}
+		if _, err := certs.GetCertificate(nil); err != nil {
+			return nil, err
+		}
+		tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.GetCertificate(nil)
+		}
+	}
+	return tc, nil
+}
+
+// certReloader provides the server certificate, reloading it from disk
+// whenever the modification time of the certificate or key file changes so
+// that rotated certificates are used without restarting.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return r.fallback(err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return r.fallback(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil && certInfo.ModTime().Equal(r.certTime) && keyInfo.ModTime().Equal(r.keyTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert == nil {
+			return nil, err
+		}
+		// The files may be midway through being rotated, in which case the
+		// next handshake will pick up the new certificate.
+		log.Printf("failed to reload TLS certificate, using the previous one: %v", err)
+		return r.cert, nil
+	}
+	r.cert, r.certTime, r.keyTime = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	return r.cert, nil
+}
+
+// fallback returns the last loaded certificate, if any, or err otherwise.
+func (r *certReloader) fallback(err error) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert == nil {
+		return nil, err
+	}
+	log.Printf("failed to reload TLS certificate, using the previous one: %v", err)
+	return r.cert, nil
+}
+
+// loadCertPool loads the PEM encoded certificates of the given file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
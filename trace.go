@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// phaseTrace records when each phase of fetching from a target happened, to
+// tell where the time went when the fetch times out.
+type phaseTrace struct {
+	start time.Time
+
+	mu           sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	firstByte    time.Time
+}
+
+func newPhaseTrace() *phaseTrace {
+	return &phaseTrace{start: time.Now()}
+}
+
+// withContext returns ctx with the trace attached to it.
+func (p *phaseTrace) withContext(ctx context.Context) context.Context {
+	now := func(t *time.Time) {
+		p.mu.Lock()
+		*t = time.Now()
+		p.mu.Unlock()
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { now(&p.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { now(&p.dnsDone) },
+		ConnectStart:         func(string, string) { now(&p.connectStart) },
+		ConnectDone:          func(string, string, error) { now(&p.connectDone) },
+		TLSHandshakeStart:    func() { now(&p.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { now(&p.tlsDone) },
+		GotFirstResponseByte: func() { now(&p.firstByte) },
+	})
+}
+
+// breakdown describes how long each phase took up to end. Phases that
+// started but didn't finish are marked as incomplete.
+func (p *phaseTrace) breakdown(end time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var phases []string
+	phase := func(name string, start, done time.Time) {
+		switch {
+		case start.IsZero():
+		case done.IsZero():
+			phases = append(phases, fmt.Sprintf("%s=incomplete after %s", name, end.Sub(start)))
+		default:
+			phases = append(phases, fmt.Sprintf("%s=%s", name, done.Sub(start)))
+		}
+	}
+	phase("dns", p.dnsStart, p.dnsDone)
+	phase("connect", p.connectStart, p.connectDone)
+	phase("tls", p.tlsStart, p.tlsDone)
+	phase("first_byte", p.start, p.firstByte)
+	if !p.firstByte.IsZero() {
+		phases = append(phases, fmt.Sprintf("body=%s", end.Sub(p.firstByte)))
+	}
+	return strings.Join(phases, " ")
+}
+
+// isTimeout reports whether err is due to a timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
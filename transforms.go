@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// transform modifies the metric families of a target in place.
+type transform func(metricFamilies map[string]*dto.MetricFamily)
+
+// transforms are the named transforms that can be listed in the transforms
+// of a target, packaging common relabeling recipes.
+var transforms = map[string]transform{
+	"strip_go_metrics":        stripGoMetrics,
+	"normalize_counter_names": normalizeCounterNames,
+	"lowercase_labels":        lowercaseLabels,
+}
+
+// stripGoMetrics drops the go_* metrics exposed by the Go client library.
+func stripGoMetrics(metricFamilies map[string]*dto.MetricFamily) {
+	for n := range metricFamilies {
+		if strings.HasPrefix(n, "go_") {
+			delete(metricFamilies, n)
+		}
+	}
+}
+
+// normalizeCounterNames adds the conventional _total suffix to the names of
+// counters lacking it, unless a family of another type already has that name.
+func normalizeCounterNames(metricFamilies map[string]*dto.MetricFamily) {
+	var renamed []*dto.MetricFamily
+	for n, mf := range metricFamilies {
+		if mf.GetType() == dto.MetricType_COUNTER && !strings.HasSuffix(n, "_total") {
+			if other, ok := metricFamilies[n+"_total"]; ok && other.GetType() != dto.MetricType_COUNTER {
+				continue
+			}
+			delete(metricFamilies, n)
+			name := n + "_total"
+			mf.Name = &name
+			renamed = append(renamed, mf)
+		}
+	}
+	for _, mf := range renamed {
+		if emf, ok := metricFamilies[mf.GetName()]; ok {
+			emf.Metric = append(emf.Metric, mf.Metric...)
+		} else {
+			metricFamilies[mf.GetName()] = mf
+		}
+	}
+}
+
+// lowercaseLabels lower-cases the names of all labels, except those which
+// would then clash with another label of the same series.
+func lowercaseLabels(metricFamilies map[string]*dto.MetricFamily) {
+	for _, mf := range metricFamilies {
+		for _, m := range mf.Metric {
+			names := make(map[string]bool, len(m.Label))
+			for _, l := range m.Label {
+				names[l.GetName()] = true
+			}
+			for _, l := range m.Label {
+				name := strings.ToLower(l.GetName())
+				if name == l.GetName() || names[name] {
+					continue
+				}
+				delete(names, l.GetName())
+				names[name] = true
+				l.Name = &name
+			}
+		}
+	}
+}
+
+// handleNonFinite drops the counter, gauge and untyped samples whose value
+// is NaN or infinite if action is drop, or replaces their value with
+// replacement if action is replace.
+func handleNonFinite(metricFamilies map[string]*dto.MetricFamily, action string, replacement float64) {
+	for n, mf := range metricFamilies {
+		kept := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			var v *float64
+			switch {
+			case m.Counter != nil:
+				v = m.Counter.Value
+			case m.Gauge != nil:
+				v = m.Gauge.Value
+			case m.Untyped != nil:
+				v = m.Untyped.Value
+			}
+			if v == nil || !math.IsNaN(*v) && !math.IsInf(*v, 0) {
+				kept = append(kept, m)
+				continue
+			}
+			if action == "replace" {
+				*v = replacement
+				kept = append(kept, m)
+			}
+		}
+		mf.Metric = kept
+		if len(mf.Metric) == 0 {
+			delete(metricFamilies, n)
+		}
+	}
+}
+
+// renameNestedSelfMetrics renames the pue_* metrics of a nested exporter to
+// pue_nested_*, so they don't collide with the exporter's own.
+func renameNestedSelfMetrics(metricFamilies map[string]*dto.MetricFamily) {
+	var renamed []*dto.MetricFamily
+	for n, mf := range metricFamilies {
+		if strings.HasPrefix(n, "pue_") {
+			delete(metricFamilies, n)
+			name := "pue_nested_" + strings.TrimPrefix(n, "pue_")
+			mf.Name = &name
+			renamed = append(renamed, mf)
+		}
+	}
+	for _, mf := range renamed {
+		metricFamilies[mf.GetName()] = mf
+	}
+}
+
+// prefixMetricNames prepends prefix to the names of all metric families.
+func prefixMetricNames(metricFamilies map[string]*dto.MetricFamily, prefix string) {
+	renamed := make([]*dto.MetricFamily, 0, len(metricFamilies))
+	for n, mf := range metricFamilies {
+		delete(metricFamilies, n)
+		name := prefix + n
+		mf.Name = &name
+		renamed = append(renamed, mf)
+	}
+	for _, mf := range renamed {
+		metricFamilies[mf.GetName()] = mf
+	}
+}
+
+// MetricRename renames the metric families whose name fully matches the
+// Match regex to Replacement, in which $1 and the like refer to the groups of
+// Match.
+type MetricRename struct {
+	Match       string `yaml:"match"`
+	Replacement string `yaml:"replacement"`
+}
+
+// metricRename is the compiled form of MetricRename.
+type metricRename struct {
+	match       *regexp.Regexp
+	replacement string
+}
+
+// renameMetrics applies the renames, in order, to the names of the metric
+// families. A family renamed to the name of another one of the same type is
+// merged into it, while renames to invalid names or clashing with a family of
+// a different type are ignored.
+func renameMetrics(metricFamilies map[string]*dto.MetricFamily, renames []metricRename) {
+	for _, r := range renames {
+		renamed := map[string]*dto.MetricFamily{}
+		for n, mf := range metricFamilies {
+			if !r.match.MatchString(n) {
+				continue
+			}
+			name := r.match.ReplaceAllString(n, r.replacement)
+			if name == n || !model.IsValidMetricName(model.LabelValue(name)) {
+				continue
+			}
+			if other, ok := metricFamilies[name]; ok && other.GetType() != mf.GetType() {
+				continue
+			}
+			delete(metricFamilies, n)
+			renamed[n] = mf
+		}
+		for n, mf := range renamed {
+			name := r.match.ReplaceAllString(n, r.replacement)
+			other, ok := metricFamilies[name]
+			switch {
+			case !ok:
+				mf.Name = &name
+				metricFamilies[name] = mf
+			case other.GetType() == mf.GetType():
+				other.Metric = append(other.Metric, mf.Metric...)
+			default:
+				metricFamilies[n] = mf
+			}
+		}
+	}
+}
+
+// compileAnchored compiles regexes to only match whole strings.
+func compileAnchored(exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// filterMetrics drops the metric families whose name doesn't match any of
+// allow, if set, or matches any of deny.
+func filterMetrics(metricFamilies map[string]*dto.MetricFamily, allow, deny []*regexp.Regexp) {
+	for n := range metricFamilies {
+		if len(allow) > 0 && !matchesAny(allow, n) || matchesAny(deny, n) {
+			delete(metricFamilies, n)
+		}
+	}
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropMatchingLabels strips the labels whose name matches any of res from
+// all metrics.
+func dropMatchingLabels(metricFamilies map[string]*dto.MetricFamily, res []*regexp.Regexp) {
+	for _, mf := range metricFamilies {
+		for _, m := range mf.Metric {
+			kept := m.Label[:0]
+			for _, l := range m.Label {
+				if !matchesAny(res, l.GetName()) {
+					kept = append(kept, l)
+				}
+			}
+			m.Label = kept
+		}
+	}
+}
+
+// LabelMapping rewrites the values of a label.
+type LabelMapping struct {
+	// Values maps values to their replacement. Values not listed are kept.
+	Values map[string]string `yaml:"values"`
+	// Case, if set to lower or upper, changes the case of values, after
+	// mapping them.
+	Case string `yaml:"case"`
+}
+
+// mapLabelValues rewrites the values of the labels of all metrics according
+// to the mappings, keyed by label name.
+func mapLabelValues(metricFamilies map[string]*dto.MetricFamily, mappings map[string]LabelMapping) {
+	for _, mf := range metricFamilies {
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				mapping, ok := mappings[l.GetName()]
+				if !ok {
+					continue
+				}
+				v := l.GetValue()
+				if mapped, ok := mapping.Values[v]; ok {
+					v = mapped
+				}
+				switch mapping.Case {
+				case "lower":
+					v = strings.ToLower(v)
+				case "upper":
+					v = strings.ToUpper(v)
+				}
+				l.Value = &v
+			}
+		}
+	}
+}
+
+// validateLabelMap checks the mappings of a label_map.
+func validateLabelMap(mappings map[string]LabelMapping) error {
+	for name, mapping := range mappings {
+		switch mapping.Case {
+		case "", "lower", "upper":
+		default:
+			return fmt.Errorf("%s: unknown case %q, must be lower or upper", name, mapping.Case)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testTarget loads a config with a single target configured by the YAML
+// fragment config and returns the target.
+func testTarget(t *testing.T, config string) Target {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("targets:\n  - url: http://127.0.0.1:9100/metrics\n")
+	for _, line := range strings.Split(strings.TrimSpace(config), "\n") {
+		b.WriteString("    " + line + "\n")
+	}
+	return loadTestConfig(t, b.String()).Targets[0]
+}
+
+// checkTransform checks that the metrics in the text format input are
+// transformed into want by the target configured by the YAML fragment config.
+func checkTransform(t *testing.T, config, input, want string) {
+	t.Helper()
+	target := testTarget(t, config)
+	if got := formatText(t, transformMetrics(target, parseText(t, input))); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		input  string
+		want   string
+	}{
+		{
+			name:   "strip_go_metrics",
+			config: "transforms: [strip_go_metrics]",
+			input: `# TYPE go_goroutines gauge
+go_goroutines 10
+# TYPE process_open_fds gauge
+process_open_fds 5
+# TYPE up gauge
+up 1
+`,
+			want: `# TYPE process_open_fds gauge
+process_open_fds 5
+# TYPE up gauge
+up 1
+`,
+		},
+		{
+			name:   "normalize_counter_names",
+			config: "transforms: [normalize_counter_names]",
+			input: `# TYPE requests counter
+requests{code="200"} 3
+# TYPE errors_total counter
+errors_total 1
+# TYPE temperature gauge
+temperature 20
+`,
+			want: `# TYPE errors_total counter
+errors_total 1
+# TYPE requests_total counter
+requests_total{code="200"} 3
+# TYPE temperature gauge
+temperature 20
+`,
+		},
+		{
+			name:   "normalize_counter_names merging",
+			config: "transforms: [normalize_counter_names]",
+			input: `# TYPE requests counter
+requests{code="200"} 3
+# TYPE requests_total counter
+requests_total{code="500"} 1
+`,
+			want: `# TYPE requests_total counter
+requests_total{code="500"} 1
+requests_total{code="200"} 3
+`,
+		},
+		{
+			name:   "normalize_counter_names type clash",
+			config: "transforms: [normalize_counter_names]",
+			input: `# TYPE requests counter
+requests 3
+# TYPE requests_total gauge
+requests_total 1
+`,
+			want: `# TYPE requests counter
+requests 3
+# TYPE requests_total gauge
+requests_total 1
+`,
+		},
+		{
+			name:   "lowercase_labels",
+			config: "transforms: [lowercase_labels]",
+			input: `# TYPE up gauge
+up{Env="prod",Zone="a"} 1
+`,
+			want: `# TYPE up gauge
+up{env="prod",zone="a"} 1
+`,
+		},
+		{
+			name:   "lowercase_labels clash",
+			config: "transforms: [lowercase_labels]",
+			input: `# TYPE up gauge
+up{Env="prod",env="dev"} 1
+`,
+			want: `# TYPE up gauge
+up{Env="prod",env="dev"} 1
+`,
+		},
+		{
+			name:   "in order",
+			config: "transforms: [lowercase_labels, strip_go_metrics]",
+			input: `# TYPE go_goroutines gauge
+go_goroutines{Env="prod"} 10
+# TYPE up gauge
+up{Env="prod"} 1
+`,
+			want: `# TYPE up gauge
+up{env="prod"} 1
+`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			checkTransform(t, tt.config, tt.input, tt.want)
+		})
+	}
+}
+
+func TestTransformsUnknown(t *testing.T) {
+	path := writeTestConfig(t, "targets:\n  - url: http://127.0.0.1:9100/metrics\n    transforms: [strip_everything]\n")
+	if _, err := loadConfig(path); err == nil {
+		t.Error("got no error for an unknown transform")
+	}
+}
+
+func TestNonFiniteValues(t *testing.T) {
+	const input = `# TYPE a gauge
+a{i="1"} NaN
+a{i="2"} 1
+# TYPE b counter
+b +Inf
+# TYPE c untyped
+c -Inf
+# TYPE d histogram
+d_bucket{le="+Inf"} 1
+d_sum NaN
+d_count 1
+`
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "keep",
+			config: "non_finite_values: keep",
+			want:   input,
+		},
+		{
+			name:   "drop",
+			config: "non_finite_values: drop",
+			want: `# TYPE a gauge
+a{i="2"} 1
+# TYPE d histogram
+d_bucket{le="+Inf"} 1
+d_sum NaN
+d_count 1
+`,
+		},
+		{
+			name:   "replace",
+			config: "non_finite_values: replace\nnon_finite_replacement: -1",
+			want: `# TYPE a gauge
+a{i="1"} -1
+a{i="2"} 1
+# TYPE b counter
+b -1
+# TYPE c untyped
+c -1
+# TYPE d histogram
+d_bucket{le="+Inf"} 1
+d_sum NaN
+d_count 1
+`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			checkTransform(t, tt.config, input, tt.want)
+		})
+	}
+}
+
+func TestNonFiniteValuesUnknown(t *testing.T) {
+	path := writeTestConfig(t, "targets:\n  - url: http://127.0.0.1:9100/metrics\n    non_finite_values: zero\n")
+	if _, err := loadConfig(path); err == nil {
+		t.Error("got no error for an unknown non_finite_values")
+	}
+}
+
+func TestMetricPrefix(t *testing.T) {
+	const input = `# TYPE requests_total counter
+requests_total 3
+# TYPE up gauge
+up{job="node"} 1
+`
+	tests := []struct {
+		name    string
+		config  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "unset",
+			want: input,
+		},
+		{
+			name:   "prefixed",
+			config: "metric_prefix: node_",
+			want: `# TYPE node_requests_total counter
+node_requests_total 3
+# TYPE node_up gauge
+node_up{job="node"} 1
+`,
+		},
+		{
+			name:    "invalid",
+			config:  "metric_prefix: 1node_",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantErr {
+				path := writeTestConfig(t, "targets:\n  - url: http://127.0.0.1:9100/metrics\n    "+tt.config+"\n")
+				if _, err := loadConfig(path); err == nil {
+					t.Error("got no error for an invalid metric_prefix")
+				}
+				return
+			}
+			checkTransform(t, tt.config, input, tt.want)
+		})
+	}
+}
+
+func TestMetricRenames(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		input  string
+		want   string
+	}{
+		{
+			name:   "groups",
+			config: "metric_renames:\n  - match: node_(.+)_bytes\n    replacement: host_${1}_bytes",
+			input: `# TYPE node_memory_bytes gauge
+node_memory_bytes 1024
+# TYPE node_load1 gauge
+node_load1 0.5
+`,
+			want: `# TYPE host_memory_bytes gauge
+host_memory_bytes 1024
+# TYPE node_load1 gauge
+node_load1 0.5
+`,
+		},
+		{
+			name:   "whole name only",
+			config: "metric_renames:\n  - match: up\n    replacement: alive",
+			input: `# TYPE up gauge
+up 1
+# TYPE upstream_up gauge
+upstream_up 1
+`,
+			want: `# TYPE alive gauge
+alive 1
+# TYPE upstream_up gauge
+upstream_up 1
+`,
+		},
+		{
+			name:   "in order",
+			config: "metric_renames:\n  - match: a\n    replacement: b\n  - match: b\n    replacement: c",
+			input: `# TYPE a gauge
+a 1
+`,
+			want: `# TYPE c gauge
+c 1
+`,
+		},
+		{
+			name:   "merged into same type",
+			config: "metric_renames:\n  - match: legacy_(.+)\n    replacement: $1",
+			input: `# TYPE legacy_requests_total counter
+legacy_requests_total{path="/login"} 2
+# TYPE requests_total counter
+requests_total{path="/"} 1
+`,
+			want: `# TYPE requests_total counter
+requests_total{path="/"} 1
+requests_total{path="/login"} 2
+`,
+		},
+		{
+			name:   "clash with another type",
+			config: "metric_renames:\n  - match: a\n    replacement: b",
+			input: `# TYPE a gauge
+a 1
+# TYPE b counter
+b 2
+`,
+			want: `# TYPE a gauge
+a 1
+# TYPE b counter
+b 2
+`,
+		},
+		{
+			name:   "invalid name",
+			config: "metric_renames:\n  - match: a\n    replacement: 1a",
+			input: `# TYPE a gauge
+a 1
+`,
+			want: `# TYPE a gauge
+a 1
+`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			checkTransform(t, tt.config, tt.input, tt.want)
+		})
+	}
+}
+
+func TestMetricAllowDeny(t *testing.T) {
+	const input = `# TYPE node_cpu_seconds_total counter
+node_cpu_seconds_total 10
+# TYPE node_load1 gauge
+node_load1 0.5
+# TYPE up gauge
+up 1
+`
+	tests := []struct {
+		name    string
+		config  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "allow",
+			config: "metric_allow: [node_.*]",
+			want: `# TYPE node_cpu_seconds_total counter
+node_cpu_seconds_total 10
+# TYPE node_load1 gauge
+node_load1 0.5
+`,
+		},
+		{
+			name:   "deny",
+			config: "metric_deny: [node_load.*, up]",
+			want: `# TYPE node_cpu_seconds_total counter
+node_cpu_seconds_total 10
+`,
+		},
+		{
+			name:   "deny wins over allow",
+			config: "metric_allow: [node_.*]\nmetric_deny: [node_load1]",
+			want: `# TYPE node_cpu_seconds_total counter
+node_cpu_seconds_total 10
+`,
+		},
+		{
+			name:   "whole name only",
+			config: "metric_allow: [node]",
+			want:   "",
+		},
+		{
+			name:    "invalid regex",
+			config:  "metric_deny: [\"node_(\"]",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantErr {
+				path := writeTestConfig(t, "targets:\n  - url: http://127.0.0.1:9100/metrics\n    "+tt.config+"\n")
+				if _, err := loadConfig(path); err == nil {
+					t.Error("got no error for an invalid regex")
+				}
+				return
+			}
+			checkTransform(t, tt.config, input, tt.want)
+		})
+	}
+}
+
+func TestSeriesDropLabels(t *testing.T) {
+	const input = `# TYPE up gauge
+up{job="node",pod_ip="10.0.0.1",pod_name="a"} 1
+`
+	tests := []struct {
+		name   string
+		config string
+		global bool
+		want   string
+	}{
+		{
+			name:   "target",
+			config: "series_drop_labels: [pod_.*]",
+			want: `# TYPE up gauge
+up{job="node"} 1
+`,
+		},
+		{
+			name:   "target whole name only",
+			config: "series_drop_labels: [pod]",
+			want:   input,
+		},
+		{
+			name:   "target after labels",
+			config: "labels:\n  pod_zone: eu1\nseries_drop_labels: [pod_.*]",
+			want: `# TYPE up gauge
+up{job="node"} 1
+`,
+		},
+		{
+			name:   "global",
+			config: "series_drop_labels: [pod_ip, pod_name]",
+			global: true,
+			want: `# TYPE up gauge
+up{job="node"} 1
+`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.global {
+				checkTransform(t, tt.config, input, tt.want)
+				return
+			}
+			cfg := loadTestConfig(t, tt.config+"\ntargets:\n  - url: http://127.0.0.1:9100/metrics\n")
+			mfs := parseText(t, input)
+			transformMerged(cfg, mfs)
+			if got := formatText(t, mfs); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelMap(t *testing.T) {
+	const input = `# TYPE up gauge
+up{env="PRD",region="EU-West"} 1
+up{env="dev",region="US-East"} 1
+`
+	tests := []struct {
+		name    string
+		config  string
+		global  bool
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "values",
+			config: "label_map:\n  env:\n    values:\n      PRD: production",
+			want: `# TYPE up gauge
+up{env="production",region="EU-West"} 1
+up{env="dev",region="US-East"} 1
+`,
+		},
+		{
+			name:   "case",
+			config: "label_map:\n  region:\n    case: lower",
+			want: `# TYPE up gauge
+up{env="PRD",region="eu-west"} 1
+up{env="dev",region="us-east"} 1
+`,
+		},
+		{
+			name:   "case after values",
+			config: "label_map:\n  env:\n    values:\n      dev: development\n    case: upper",
+			want: `# TYPE up gauge
+up{env="PRD",region="EU-West"} 1
+up{env="DEVELOPMENT",region="US-East"} 1
+`,
+		},
+		{
+			name:   "global",
+			config: "label_map:\n  region:\n    case: upper",
+			global: true,
+			want: `# TYPE up gauge
+up{env="PRD",region="EU-WEST"} 1
+up{env="dev",region="US-EAST"} 1
+`,
+		},
+		{
+			name:    "unknown case",
+			config:  "label_map:\n  env:\n    case: title",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			switch {
+			case tt.wantErr:
+				var b strings.Builder
+				b.WriteString("targets:\n  - url: http://127.0.0.1:9100/metrics\n")
+				for _, line := range strings.Split(tt.config, "\n") {
+					b.WriteString("    " + line + "\n")
+				}
+				if _, err := loadConfig(writeTestConfig(t, b.String())); err == nil {
+					t.Error("got no error for an unknown case")
+				}
+			case tt.global:
+				cfg := loadTestConfig(t, tt.config+"\ntargets:\n  - url: http://127.0.0.1:9100/metrics\n")
+				mfs := parseText(t, input)
+				transformMerged(cfg, mfs)
+				if got := formatText(t, mfs); got != tt.want {
+					t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+				}
+			default:
+				checkTransform(t, tt.config, input, tt.want)
+			}
+		})
+	}
+}
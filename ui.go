@@ -0,0 +1,83 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// statusPage lists targets along with their health.
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Prometheus Unified Exporter</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+.up { background: #dfd; }
+.down { background: #fdd; }
+.errors { font-size: small; margin: 0; padding-left: 1em; }
+</style>
+</head>
+<body>
+<h1>Prometheus Unified Exporter</h1>
+<p><a href="/metrics">Metrics</a> &middot; <a href="/targets">Targets (JSON)</a> &middot; <a href="/service-discovery">Service discovery</a></p>
+<p>{{.Up}} of {{len .Targets}} targets up.</p>
+<table>
+<tr><th>Target</th><th>Labels</th><th>Health</th><th>Last scrape</th><th>Duration</th><th>Samples</th><th>Recent errors</th></tr>
+{{range .Targets}}<tr class="{{.Health}}">
+<td>{{.URL}}</td>
+<td>{{range $k, $v := .Labels}}{{$k}}="{{$v}}" {{end}}</td>
+<td>{{.Health}}</td>
+<td>{{if .LastScrape.IsZero}}never{{else}}{{.LastScrape.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{printf "%.3fs" .Duration.Seconds}}</td>
+<td>{{.Samples}}</td>
+<td>{{if .RecentErrors}}<ul class="errors">{{range .RecentErrors}}<li>{{.Time.Format "15:04:05"}}: {{.Err}}</li>{{end}}</ul>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// targetRow is a row of the status page.
+type targetRow struct {
+	URL    string
+	Labels map[string]string
+	Health string
+	targetStatus
+}
+
+// handleStatus serves an HTML page listing the active targets along with
+// their health, for checking on them at a glance.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	var data struct {
+		Up      int
+		Targets []targetRow
+	}
+	targetStatusesMu.Lock()
+	for _, t := range activeTargets(currentConfig()) {
+		row := targetRow{URL: t.URL, Labels: t.Labels, Health: "unknown"}
+		if status, ok := targetStatuses[t.URL]; ok {
+			row.targetStatus = status
+			row.Health = "up"
+			if status.Err != nil {
+				row.Health = "down"
+			}
+		}
+		if row.Health == "up" {
+			data.Up++
+		}
+		data.Targets = append(data.Targets, row)
+	}
+	targetStatusesMu.Unlock()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPage.Execute(w, data); err != nil {
+		log.Printf("failed to write status page: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// maxValidationProblems caps the number of problems reported by
+// validateMetrics.
+const maxValidationProblems = 10
+
+// validateMetrics checks that the metric families make a valid exposition:
+// valid metric and label names, metrics matching the type of their family
+// and no duplicate series.
+func validateMetrics(metricFamilies map[string]*dto.MetricFamily) error {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	for n, mf := range metricFamilies {
+		if len(problems) >= maxValidationProblems {
+			break
+		}
+		if n != mf.GetName() {
+			report("metric family %q listed as %q", mf.GetName(), n)
+		}
+		if !model.IsValidMetricName(model.LabelValue(mf.GetName())) {
+			report("invalid metric name %q", mf.GetName())
+		}
+		seen := map[string]bool{}
+		for _, m := range mf.Metric {
+			if !hasType(m, mf.GetType()) {
+				report("%s: metric of the wrong type for a %s", mf.GetName(), mf.GetType())
+			}
+			names := map[string]bool{}
+			for _, l := range m.Label {
+				if !model.LabelName(l.GetName()).IsValid() {
+					report("%s: invalid label name %q", mf.GetName(), l.GetName())
+				}
+				if names[l.GetName()] {
+					report("%s: duplicate label %q", mf.GetName(), l.GetName())
+				}
+				names[l.GetName()] = true
+			}
+			s := seriesString(mf.GetName(), m)
+			if seen[s] {
+				report("duplicate series %s", s)
+			}
+			seen[s] = true
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	if len(problems) > maxValidationProblems {
+		problems = problems[:maxValidationProblems]
+	}
+	return fmt.Errorf("invalid output: %s", strings.Join(problems, "; "))
+}
+
+// hasType reports whether metric m holds a value of the given type.
+func hasType(m *dto.Metric, typ dto.MetricType) bool {
+	switch typ {
+	case dto.MetricType_COUNTER:
+		return m.Counter != nil
+	case dto.MetricType_GAUGE:
+		return m.Gauge != nil
+	case dto.MetricType_SUMMARY:
+		return m.Summary != nil
+	case dto.MetricType_UNTYPED:
+		return m.Untyped != nil
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		return m.Histogram != nil
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultConfig configures fetching secrets from HashiCorp Vault. Credential
+// options of targets can then reference secrets as vault:<path>#<key>, e.g.
+// vault:secret/data/metrics#password for the password key of a KV v2
+// secret.
+type VaultConfig struct {
+	// Address is the address of Vault, by default taken from the
+	// VAULT_ADDR env var.
+	Address string `yaml:"address"`
+	// TokenFile is the path of a file holding the token to authenticate
+	// with, read whenever secrets are fetched, e.g. as written by Vault
+	// Agent. By default, the token is taken from the VAULT_TOKEN env var and
+	// renewed periodically if it's renewable.
+	TokenFile string `yaml:"token_file"`
+	// CacheTTL is how long secrets without a lease are cached for, 5m by
+	// default. Secrets with a lease are cached for the duration of their
+	// lease.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// vaultRefPrefix is the prefix of values referencing Vault secrets.
+const vaultRefPrefix = "vault:"
+
+// vaultClient fetches secrets from Vault, caching them.
+type vaultClient struct {
+	cfg    VaultConfig
+	client *http.Client
+	// done is closed to stop renewing the token.
+	done chan struct{}
+
+	mu    sync.Mutex
+	cache map[string]vaultSecret
+}
+
+// vaultSecret is a secret fetched from Vault.
+type vaultSecret struct {
+	data    map[string]interface{}
+	expires time.Time
+}
+
+func newVaultClient(cfg VaultConfig) (*vaultClient, error) {
+	if cfg.Address == "" {
+		cfg.Address = os.Getenv("VAULT_ADDR")
+	}
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("address must be set, or the VAULT_ADDR env var")
+	}
+	if cfg.TokenFile == "" && os.Getenv("VAULT_TOKEN") == "" {
+		return nil, fmt.Errorf("token_file must be set, or the VAULT_TOKEN env var")
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = 5 * time.Minute
+	}
+	return &vaultClient{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		done:   make(chan struct{}),
+		cache:  map[string]vaultSecret{},
+	}, nil
+}
+
+func (v *vaultClient) token() (string, error) {
+	if v.cfg.TokenFile != "" {
+		return readSecretFile(v.cfg.TokenFile)
+	}
+	return os.Getenv("VAULT_TOKEN"), nil
+}
+
+// do makes a request to the Vault API and decodes the response into out.
+func (v *vaultClient) do(method, path string, out interface{}) error {
+	token, err := v.token()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(v.cfg.Address, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: unexpected status %s", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// read returns the data of the secret at path, fetching it if it isn't
+// cached or its lease expired. The data of KV v2 secrets is unwrapped.
+func (v *vaultClient) read(path string) (map[string]interface{}, error) {
+	v.mu.Lock()
+	s, ok := v.cache[path]
+	v.mu.Unlock()
+	if ok && time.Now().Before(s.expires) {
+		return s.data, nil
+	}
+	var resp struct {
+		LeaseDuration int                    `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err := v.do(http.MethodGet, (&url.URL{Path: path}).EscapedPath(), &resp); err != nil {
+		return nil, err
+	}
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	ttl := v.cfg.CacheTTL
+	if resp.LeaseDuration > 0 {
+		ttl = time.Duration(resp.LeaseDuration) * time.Second
+	}
+	v.mu.Lock()
+	v.cache[path] = vaultSecret{data: data, expires: time.Now().Add(ttl)}
+	v.mu.Unlock()
+	return data, nil
+}
+
+// expand returns value, or the secret it references if it's of the form
+// vault:<path>#<key>.
+func (v *vaultClient) expand(value string) (string, error) {
+	ref, ok := strings.CutPrefix(value, vaultRefPrefix)
+	if !ok {
+		return value, nil
+	}
+	if v == nil {
+		return "", fmt.Errorf("%s references a vault secret but vault isn't configured", value)
+	}
+	path, key, ok := strings.Cut(ref, "#")
+	if !ok {
+		return "", fmt.Errorf("%s: missing #<key>", value)
+	}
+	data, err := v.read(path)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", value, err)
+	}
+	secret, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("%s: no such string key", value)
+	}
+	return secret, nil
+}
+
+// renewToken renews the token from the VAULT_TOKEN env var at half its TTL
+// until stopped, or the token turns out not to be renewable. Tokens read
+// from a file are left to whatever writes the file.
+func (v *vaultClient) renewToken() {
+	if v.cfg.TokenFile != "" {
+		return
+	}
+	for {
+		var resp struct {
+			Auth struct {
+				LeaseDuration int  `json:"lease_duration"`
+				Renewable     bool `json:"renewable"`
+			} `json:"auth"`
+		}
+		wait := time.Minute
+		if err := v.do(http.MethodPost, "auth/token/renew-self", &resp); err != nil {
+			warnf("failed to renew vault token: %v", err)
+		} else if !resp.Auth.Renewable || resp.Auth.LeaseDuration <= 0 {
+			return
+		} else {
+			wait = time.Duration(resp.Auth.LeaseDuration) * time.Second / 2
+		}
+		select {
+		case <-v.done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// stop makes renewToken return.
+func (v *vaultClient) stop() {
+	close(v.done)
+}